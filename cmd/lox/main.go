@@ -2,26 +2,44 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/mmcclimon/glox/lox"
 )
 
+const usage = `usage: lox [path]
+       lox compile path [-o output]
+       lox run path`
+
+var debugFlags = lox.DebugFlags{PrintCode: true}
+
 func main() {
-	if len(os.Args) == 1 {
+	args := os.Args[1:]
+
+	switch {
+	case len(args) == 0:
 		repl()
-	} else if len(os.Args) == 2 {
-		runFile(os.Args[1])
-	} else {
-		fmt.Fprintln(os.Stderr, "usage: lox [path]")
+	case args[0] == "compile" && len(args) > 1:
+		compileFile(args[1:])
+	case args[0] == "run" && len(args) == 2:
+		runFile(args[1])
+	case len(args) == 1:
+		runFile(args[0])
+	default:
+		fmt.Fprintln(os.Stderr, usage)
 		os.Exit(64)
 	}
 }
 
 func repl() {
 	vm := lox.NewVM()
+	vm.SetDebug(debugFlags)
 
 	scanner := bufio.NewScanner(os.Stdin)
 
@@ -38,20 +56,83 @@ func repl() {
 	}
 }
 
+// runFile runs either Lox source or compiled bytecode, depending on what's in
+// the file.
 func runFile(filename string) {
-	bytes, err := os.ReadFile(filename)
+	data := readFile(filename)
 
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error reading file: %s\n", err)
-		os.Exit(74)
+	vm := lox.NewVM()
+	vm.SetDebug(debugFlags)
+
+	var err error
+	if lox.IsBytecode(data) {
+		function, loadErr := lox.ReadBytecode(bytes.NewReader(data))
+		if loadErr != nil {
+			fmt.Fprintf(os.Stderr, "error loading %s: %s\n", filename, loadErr)
+			os.Exit(65)
+		}
+
+		err = vm.Interpret(function)
+	} else {
+		err = vm.InterpretString(string(data))
 	}
 
-	vm := lox.NewVM()
-	err = vm.InterpretString(string(bytes))
+	if errors.Is(err, lox.InterpretCompileError) {
+		os.Exit(65)
+	} else if errors.Is(err, lox.InterpretRuntimeError) {
+		os.Exit(70)
+	}
+}
+
+func compileFile(args []string) {
+	var input, output string
+
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-o" && i+1 < len(args):
+			output = args[i+1]
+			i++
+		case input == "":
+			input = args[i]
+		default:
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(64)
+		}
+	}
 
-	if err == lox.InterpretCompileError {
+	if input == "" {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(64)
+	}
+
+	if output == "" {
+		output = strings.TrimSuffix(input, filepath.Ext(input)) + ".loxc"
+	}
+
+	function, err := lox.Compile(string(readFile(input)))
+	if err != nil {
 		os.Exit(65)
-	} else if err == lox.InterpretRuntimeError {
+	}
+
+	var buf bytes.Buffer
+	if err := lox.WriteBytecode(&buf, function); err != nil {
+		fmt.Fprintf(os.Stderr, "error compiling %s: %s\n", input, err)
 		os.Exit(70)
 	}
+
+	if err := os.WriteFile(output, buf.Bytes(), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing file: %s\n", err)
+		os.Exit(74)
+	}
+}
+
+func readFile(filename string) []byte {
+	data, err := os.ReadFile(filename)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading file: %s\n", err)
+		os.Exit(74)
+	}
+
+	return data
 }
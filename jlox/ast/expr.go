@@ -0,0 +1,82 @@
+package ast
+
+import "github.com/mmcclimon/glox/jlox/token"
+
+// Expr is any expression node. Nodes are always used by pointer, so that the
+// interpreter can tell two otherwise-identical expressions apart.
+type Expr interface {
+	expr()
+}
+
+type Assign struct {
+	Name  token.Token
+	Value Expr
+}
+
+type Binary struct {
+	Left     Expr
+	Operator token.Token
+	Right    Expr
+}
+
+type Call struct {
+	Callee    Expr
+	Paren     token.Token
+	Arguments []Expr
+}
+
+type Get struct {
+	Object Expr
+	Name   token.Token
+}
+
+type Grouping struct {
+	Expression Expr
+}
+
+type Literal struct {
+	Value any
+}
+
+type Logical struct {
+	Left     Expr
+	Operator token.Token
+	Right    Expr
+}
+
+type Set struct {
+	Object Expr
+	Name   token.Token
+	Value  Expr
+}
+
+type Super struct {
+	Keyword token.Token
+	Method  token.Token
+}
+
+type This struct {
+	Keyword token.Token
+}
+
+type Unary struct {
+	Operator token.Token
+	Right    Expr
+}
+
+type Variable struct {
+	Name token.Token
+}
+
+func (*Assign) expr()   {}
+func (*Binary) expr()   {}
+func (*Call) expr()     {}
+func (*Get) expr()      {}
+func (*Grouping) expr() {}
+func (*Literal) expr()  {}
+func (*Logical) expr()  {}
+func (*Set) expr()      {}
+func (*Super) expr()    {}
+func (*This) expr()     {}
+func (*Unary) expr()    {}
+func (*Variable) expr() {}
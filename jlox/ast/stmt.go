@@ -0,0 +1,62 @@
+package ast
+
+import "github.com/mmcclimon/glox/jlox/token"
+
+type Stmt interface {
+	stmt()
+}
+
+type Block struct {
+	Statements []Stmt
+}
+
+type Class struct {
+	Name       token.Token
+	Superclass *Variable
+	Methods    []*Function
+}
+
+type Expression struct {
+	Expression Expr
+}
+
+type Function struct {
+	Name   token.Token
+	Params []token.Token
+	Body   []Stmt
+}
+
+type If struct {
+	Condition  Expr
+	ThenBranch Stmt
+	ElseBranch Stmt
+}
+
+type Print struct {
+	Expression Expr
+}
+
+type Return struct {
+	Keyword token.Token
+	Value   Expr
+}
+
+type Var struct {
+	Name        token.Token
+	Initializer Expr
+}
+
+type While struct {
+	Condition Expr
+	Body      Stmt
+}
+
+func (*Block) stmt()      {}
+func (*Class) stmt()      {}
+func (*Expression) stmt() {}
+func (*Function) stmt()   {}
+func (*If) stmt()         {}
+func (*Print) stmt()      {}
+func (*Return) stmt()     {}
+func (*Var) stmt()        {}
+func (*While) stmt()      {}
@@ -0,0 +1,161 @@
+package jlox
+
+import (
+	"fmt"
+
+	"github.com/mmcclimon/glox/jlox/ast"
+	"github.com/mmcclimon/glox/jlox/token"
+)
+
+type Callable interface {
+	Arity() int
+	Call(interpreter *Interpreter, arguments []any) (any, error)
+}
+
+type Function struct {
+	declaration   *ast.Function
+	closure       *Environment
+	isInitializer bool
+}
+
+type NativeFunction struct {
+	name     string
+	arity    int
+	function func(arguments []any) any
+}
+
+type Class struct {
+	name       string
+	superclass *Class
+	methods    map[string]*Function
+}
+
+type Instance struct {
+	class  *Class
+	fields map[string]any
+}
+
+func NewFunction(declaration *ast.Function, closure *Environment, isInitializer bool) *Function {
+	return &Function{
+		declaration:   declaration,
+		closure:       closure,
+		isInitializer: isInitializer,
+	}
+}
+
+func (f *Function) Arity() int {
+	return len(f.declaration.Params)
+}
+
+func (f *Function) Call(interpreter *Interpreter, arguments []any) (any, error) {
+	environment := NewEnvironment(f.closure)
+
+	for i, param := range f.declaration.Params {
+		environment.Define(param.Lexeme(), arguments[i])
+	}
+
+	err := interpreter.executeBlock(f.declaration.Body, environment)
+
+	if ret, isReturn := err.(*returnValue); isReturn {
+		if f.isInitializer {
+			return f.closure.GetAt(0, "this"), nil
+		}
+
+		return ret.value, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if f.isInitializer {
+		return f.closure.GetAt(0, "this"), nil
+	}
+
+	return nil, nil
+}
+
+// bind makes a new function whose closure has 'this' defined as the instance
+func (f *Function) bind(instance *Instance) *Function {
+	environment := NewEnvironment(f.closure)
+	environment.Define("this", instance)
+	return NewFunction(f.declaration, environment, f.isInitializer)
+}
+
+func (f *Function) String() string {
+	return fmt.Sprintf("<fn %s>", f.declaration.Name.Lexeme())
+}
+
+func (n *NativeFunction) Arity() int {
+	return n.arity
+}
+
+func (n *NativeFunction) Call(_ *Interpreter, arguments []any) (any, error) {
+	return n.function(arguments), nil
+}
+
+func (n *NativeFunction) String() string {
+	return fmt.Sprintf("<native fn %s>", n.name)
+}
+
+func NewClass(name string, superclass *Class, methods map[string]*Function) *Class {
+	return &Class{name: name, superclass: superclass, methods: methods}
+}
+
+func (c *Class) findMethod(name string) *Function {
+	if method, ok := c.methods[name]; ok {
+		return method
+	}
+
+	if c.superclass != nil {
+		return c.superclass.findMethod(name)
+	}
+
+	return nil
+}
+
+func (c *Class) Arity() int {
+	if initializer := c.findMethod("init"); initializer != nil {
+		return initializer.Arity()
+	}
+
+	return 0
+}
+
+func (c *Class) Call(interpreter *Interpreter, arguments []any) (any, error) {
+	instance := NewInstance(c)
+
+	if initializer := c.findMethod("init"); initializer != nil {
+		if _, err := initializer.bind(instance).Call(interpreter, arguments); err != nil {
+			return nil, err
+		}
+	}
+
+	return instance, nil
+}
+
+func (c *Class) String() string {
+	return c.name
+}
+
+func NewInstance(class *Class) *Instance {
+	return &Instance{class: class, fields: make(map[string]any)}
+}
+
+func (i *Instance) Get(name token.Token) (any, error) {
+	if value, ok := i.fields[name.Lexeme()]; ok {
+		return value, nil
+	}
+
+	if method := i.class.findMethod(name.Lexeme()); method != nil {
+		return method.bind(i), nil
+	}
+
+	return nil, NewRuntimeError(name, "Undefined property '%s'.", name.Lexeme())
+}
+
+func (i *Instance) Set(name token.Token, value any) {
+	i.fields[name.Lexeme()] = value
+}
+
+func (i *Instance) String() string {
+	return i.class.name + " instance"
+}
@@ -0,0 +1,63 @@
+package jlox
+
+import "github.com/mmcclimon/glox/jlox/token"
+
+type Environment struct {
+	enclosing *Environment
+	values    map[string]any
+}
+
+func NewEnvironment(enclosing *Environment) *Environment {
+	return &Environment{
+		enclosing: enclosing,
+		values:    make(map[string]any),
+	}
+}
+
+func (e *Environment) Define(name string, value any) {
+	e.values[name] = value
+}
+
+func (e *Environment) Get(name token.Token) (any, error) {
+	if value, ok := e.values[name.Lexeme()]; ok {
+		return value, nil
+	}
+
+	if e.enclosing != nil {
+		return e.enclosing.Get(name)
+	}
+
+	return nil, NewRuntimeError(name, "Undefined variable '%s'.", name.Lexeme())
+}
+
+func (e *Environment) Assign(name token.Token, value any) error {
+	if _, ok := e.values[name.Lexeme()]; ok {
+		e.values[name.Lexeme()] = value
+		return nil
+	}
+
+	if e.enclosing != nil {
+		return e.enclosing.Assign(name, value)
+	}
+
+	return NewRuntimeError(name, "Undefined variable '%s'.", name.Lexeme())
+}
+
+// GetAt and AssignAt skip the walk up the chain, since the resolver already
+// told us exactly how far away the variable lives.
+func (e *Environment) GetAt(distance int, name string) any {
+	return e.ancestor(distance).values[name]
+}
+
+func (e *Environment) AssignAt(distance int, name token.Token, value any) {
+	e.ancestor(distance).values[name.Lexeme()] = value
+}
+
+func (e *Environment) ancestor(distance int) *Environment {
+	environment := e
+	for i := 0; i < distance; i++ {
+		environment = environment.enclosing
+	}
+
+	return environment
+}
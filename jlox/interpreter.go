@@ -0,0 +1,465 @@
+package jlox
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/mmcclimon/glox/jlox/ast"
+	"github.com/mmcclimon/glox/jlox/token"
+)
+
+type Interpreter struct {
+	globals     *Environment
+	environment *Environment
+	locals      map[ast.Expr]int
+	stdout      io.Writer
+}
+
+type RuntimeError struct {
+	token   token.Token
+	message string
+}
+
+// returnValue isn't really an error, but returning it as one lets a return
+// statement unwind through executeBlock the same way a runtime error does.
+type returnValue struct {
+	value any
+}
+
+func NewInterpreter() *Interpreter {
+	globals := NewEnvironment(nil)
+
+	// whole seconds since we started, like the VM's clock
+	startTime := time.Now().Unix()
+	globals.Define("clock", &NativeFunction{
+		name:  "clock",
+		arity: 0,
+		function: func([]any) any {
+			return float64(time.Now().Unix() - startTime)
+		},
+	})
+
+	return &Interpreter{
+		globals:     globals,
+		environment: globals,
+		locals:      make(map[ast.Expr]int),
+		stdout:      os.Stdout,
+	}
+}
+
+// SetStdout sends the output of print statements to w.
+func (i *Interpreter) SetStdout(w io.Writer) {
+	i.stdout = w
+}
+
+func NewRuntimeError(tok token.Token, format string, args ...any) *RuntimeError {
+	return &RuntimeError{token: tok, message: fmt.Sprintf(format, args...)}
+}
+
+func (e *RuntimeError) Error() string {
+	return fmt.Sprintf("%s\n[line %d]", e.message, e.token.Line())
+}
+
+func (r *returnValue) Error() string {
+	return "return outside of function"
+}
+
+func (i *Interpreter) Interpret(statements []ast.Stmt) {
+	for _, stmt := range statements {
+		if err := i.execute(stmt); err != nil {
+			runtimeError(err)
+			return
+		}
+	}
+}
+
+// resolve is called by the resolver to record how many environments out
+// from the current one a local variable lives.
+func (i *Interpreter) resolve(expr ast.Expr, depth int) {
+	i.locals[expr] = depth
+}
+
+// statements
+func (i *Interpreter) execute(stmt ast.Stmt) error {
+	switch s := stmt.(type) {
+	case *ast.Block:
+		return i.executeBlock(s.Statements, NewEnvironment(i.environment))
+
+	case *ast.Class:
+		return i.executeClass(s)
+
+	case *ast.Expression:
+		_, err := i.evaluate(s.Expression)
+		return err
+
+	case *ast.Function:
+		function := NewFunction(s, i.environment, false)
+		i.environment.Define(s.Name.Lexeme(), function)
+		return nil
+
+	case *ast.If:
+		condition, err := i.evaluate(s.Condition)
+		if err != nil {
+			return err
+		}
+
+		if isTruthy(condition) {
+			return i.execute(s.ThenBranch)
+		} else if s.ElseBranch != nil {
+			return i.execute(s.ElseBranch)
+		}
+
+		return nil
+
+	case *ast.Print:
+		value, err := i.evaluate(s.Expression)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(i.stdout, stringify(value))
+		return nil
+
+	case *ast.Return:
+		var value any
+		if s.Value != nil {
+			var err error
+			if value, err = i.evaluate(s.Value); err != nil {
+				return err
+			}
+		}
+
+		return &returnValue{value}
+
+	case *ast.Var:
+		var value any
+		if s.Initializer != nil {
+			var err error
+			if value, err = i.evaluate(s.Initializer); err != nil {
+				return err
+			}
+		}
+
+		i.environment.Define(s.Name.Lexeme(), value)
+		return nil
+
+	case *ast.While:
+		for {
+			condition, err := i.evaluate(s.Condition)
+			if err != nil {
+				return err
+			}
+
+			if !isTruthy(condition) {
+				return nil
+			}
+
+			if err := i.execute(s.Body); err != nil {
+				return err
+			}
+		}
+	}
+
+	panic(fmt.Sprintf("unknown statement type %T", stmt))
+}
+
+func (i *Interpreter) executeBlock(statements []ast.Stmt, environment *Environment) error {
+	previous := i.environment
+	i.environment = environment
+	defer func() { i.environment = previous }()
+
+	for _, stmt := range statements {
+		if err := i.execute(stmt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (i *Interpreter) executeClass(stmt *ast.Class) error {
+	var superclass *Class
+
+	if stmt.Superclass != nil {
+		value, err := i.evaluate(stmt.Superclass)
+		if err != nil {
+			return err
+		}
+
+		var isClass bool
+		if superclass, isClass = value.(*Class); !isClass {
+			return NewRuntimeError(stmt.Superclass.Name, "Superclass must be a class.")
+		}
+	}
+
+	i.environment.Define(stmt.Name.Lexeme(), nil)
+
+	if superclass != nil {
+		i.environment = NewEnvironment(i.environment)
+		i.environment.Define("super", superclass)
+	}
+
+	methods := make(map[string]*Function)
+	for _, method := range stmt.Methods {
+		isInitializer := method.Name.Lexeme() == "init"
+		methods[method.Name.Lexeme()] = NewFunction(method, i.environment, isInitializer)
+	}
+
+	class := NewClass(stmt.Name.Lexeme(), superclass, methods)
+
+	if superclass != nil {
+		i.environment = i.environment.enclosing
+	}
+
+	return i.environment.Assign(stmt.Name, class)
+}
+
+// expressions
+func (i *Interpreter) evaluate(expr ast.Expr) (any, error) {
+	switch e := expr.(type) {
+	case *ast.Assign:
+		value, err := i.evaluate(e.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		if distance, ok := i.locals[e]; ok {
+			i.environment.AssignAt(distance, e.Name, value)
+		} else if err := i.globals.Assign(e.Name, value); err != nil {
+			return nil, err
+		}
+
+		return value, nil
+
+	case *ast.Binary:
+		return i.evaluateBinary(e)
+
+	case *ast.Call:
+		return i.evaluateCall(e)
+
+	case *ast.Get:
+		object, err := i.evaluate(e.Object)
+		if err != nil {
+			return nil, err
+		}
+
+		if instance, ok := object.(*Instance); ok {
+			return instance.Get(e.Name)
+		}
+
+		return nil, NewRuntimeError(e.Name, "Only instances have properties.")
+
+	case *ast.Grouping:
+		return i.evaluate(e.Expression)
+
+	case *ast.Literal:
+		return e.Value, nil
+
+	case *ast.Logical:
+		left, err := i.evaluate(e.Left)
+		if err != nil {
+			return nil, err
+		}
+
+		if e.Operator.Kind() == token.Or {
+			if isTruthy(left) {
+				return left, nil
+			}
+		} else if !isTruthy(left) {
+			return left, nil
+		}
+
+		return i.evaluate(e.Right)
+
+	case *ast.Set:
+		object, err := i.evaluate(e.Object)
+		if err != nil {
+			return nil, err
+		}
+
+		instance, ok := object.(*Instance)
+		if !ok {
+			return nil, NewRuntimeError(e.Name, "Only instances have fields.")
+		}
+
+		value, err := i.evaluate(e.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		instance.Set(e.Name, value)
+		return value, nil
+
+	case *ast.Super:
+		return i.evaluateSuper(e)
+
+	case *ast.This:
+		return i.lookUpVariable(e.Keyword, e)
+
+	case *ast.Unary:
+		right, err := i.evaluate(e.Right)
+		if err != nil {
+			return nil, err
+		}
+
+		switch e.Operator.Kind() {
+		case token.Bang:
+			return !isTruthy(right), nil
+		case token.Minus:
+			n, ok := right.(float64)
+			if !ok {
+				return nil, NewRuntimeError(e.Operator, "Operand must be a number.")
+			}
+
+			return -n, nil
+		}
+
+	case *ast.Variable:
+		return i.lookUpVariable(e.Name, e)
+	}
+
+	panic(fmt.Sprintf("unknown expression type %T", expr))
+}
+
+func (i *Interpreter) evaluateBinary(expr *ast.Binary) (any, error) {
+	left, err := i.evaluate(expr.Left)
+	if err != nil {
+		return nil, err
+	}
+
+	right, err := i.evaluate(expr.Right)
+	if err != nil {
+		return nil, err
+	}
+
+	switch expr.Operator.Kind() {
+	case token.EqualEqual:
+		return isEqual(left, right), nil
+	case token.BangEqual:
+		return !isEqual(left, right), nil
+
+	case token.Plus:
+		if l, ok := left.(string); ok {
+			if r, ok := right.(string); ok {
+				return l + r, nil
+			}
+		}
+
+		if l, ok := left.(float64); ok {
+			if r, ok := right.(float64); ok {
+				return l + r, nil
+			}
+		}
+
+		return nil, NewRuntimeError(expr.Operator, "Operands must be two numbers or two strings.")
+	}
+
+	l, lok := left.(float64)
+	r, rok := right.(float64)
+	if !lok || !rok {
+		return nil, NewRuntimeError(expr.Operator, "Operands must be numbers.")
+	}
+
+	switch expr.Operator.Kind() {
+	case token.Minus:
+		return l - r, nil
+	case token.Star:
+		return l * r, nil
+	case token.Slash:
+		return l / r, nil
+	case token.Greater:
+		return l > r, nil
+	case token.GreaterEqual:
+		return l >= r, nil
+	case token.Less:
+		return l < r, nil
+	case token.LessEqual:
+		return l <= r, nil
+	}
+
+	panic("unreachable")
+}
+
+func (i *Interpreter) evaluateCall(expr *ast.Call) (any, error) {
+	callee, err := i.evaluate(expr.Callee)
+	if err != nil {
+		return nil, err
+	}
+
+	arguments := make([]any, 0, len(expr.Arguments))
+	for _, argument := range expr.Arguments {
+		value, err := i.evaluate(argument)
+		if err != nil {
+			return nil, err
+		}
+
+		arguments = append(arguments, value)
+	}
+
+	function, ok := callee.(Callable)
+	if !ok {
+		return nil, NewRuntimeError(expr.Paren, "Can only call functions and classes.")
+	}
+
+	if len(arguments) != function.Arity() {
+		return nil, NewRuntimeError(expr.Paren,
+			"Expected %d arguments but got %d.", function.Arity(), len(arguments))
+	}
+
+	return function.Call(i, arguments)
+}
+
+func (i *Interpreter) evaluateSuper(expr *ast.Super) (any, error) {
+	distance := i.locals[expr]
+	superclass := i.environment.GetAt(distance, "super").(*Class)
+
+	// 'this' is always bound in the environment just inside the one with 'super'
+	this := i.environment.GetAt(distance-1, "this")
+
+	method := superclass.findMethod(expr.Method.Lexeme())
+	if method == nil {
+		return nil, NewRuntimeError(expr.Method,
+			"Undefined property '%s'.", expr.Method.Lexeme())
+	}
+
+	return method.bind(this.(*Instance)), nil
+}
+
+func (i *Interpreter) lookUpVariable(name token.Token, expr ast.Expr) (any, error) {
+	if distance, ok := i.locals[expr]; ok {
+		return i.environment.GetAt(distance, name.Lexeme()), nil
+	}
+
+	return i.globals.Get(name)
+}
+
+// helpers
+func isTruthy(value any) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	default:
+		return true
+	}
+}
+
+func isEqual(a, b any) bool {
+	return a == b
+}
+
+// stringify formats values the same way lox.PrintValue does, so that output
+// from the two interpreters can be compared directly.
+func stringify(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "nil"
+	case float64:
+		return fmt.Sprintf("%g", v)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
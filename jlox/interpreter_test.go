@@ -0,0 +1,216 @@
+package jlox
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/mmcclimon/glox/jlox/token"
+	"github.com/mmcclimon/glox/lox"
+)
+
+// interpret runs source through the whole pipeline, like run does, but with a
+// fresh interpreter, and returns what it printed and what errors it reported.
+func interpret(t *testing.T, source string) (string, string) {
+	t.Helper()
+
+	statements, errors := parse(t, source)
+	if hadError {
+		return "", errors
+	}
+
+	var stdout, stderr bytes.Buffer
+	errorOutput = &stderr
+	hadRuntimeError = false
+	t.Cleanup(func() { hadRuntimeError = false })
+
+	interpreter := NewInterpreter()
+	interpreter.SetStdout(&stdout)
+
+	NewResolver(interpreter).Resolve(statements)
+	if !hadError {
+		interpreter.Interpret(statements)
+	}
+
+	return stdout.String(), stderr.String()
+}
+
+func TestInterpret(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			"arithmetic",
+			"print 1 + 2 * 3; print (1 + 2) * 3; print 10 / 4; print -(2 - 5);",
+			"7\n9\n2.5\n3\n",
+		},
+		{
+			"strings and equality",
+			`print "a" + "b"; print "a" == "a"; print 1 == "1"; print nil == nil; print 2 >= 3;`,
+			"ab\ntrue\nfalse\ntrue\nfalse\n",
+		},
+		{
+			"truthiness",
+			`print !nil; print !0; print !""; print nil or "x"; print 1 and 2; print false and x;`,
+			"true\nfalse\nfalse\nx\n2\nfalse\n",
+		},
+		{
+			"scopes",
+			`var a = "global"; { var a = "outer"; { var a = "inner"; print a; } print a; } print a;`,
+			"inner\nouter\nglobal\n",
+		},
+		{
+			"control flow",
+			`var s = 0; for (var i = 0; i < 5; i = i + 1) { if (i == 2) s = s + 10; else s = s + i; } print s;
+			 var n = 3; while (n > 0) n = n - 1; print n;`,
+			"18\n0\n",
+		},
+		{
+			"recursion",
+			`fun fib(n) { if (n < 2) return n; return fib(n - 1) + fib(n - 2); } print fib(15);`,
+			"610\n",
+		},
+		{
+			"closures",
+			`fun makeCounter() { var n = 0; fun count() { n = n + 1; return n; } return count; }
+			 var a = makeCounter(); var b = makeCounter(); a(); a(); b(); print a(); print b();`,
+			"3\n2\n",
+		},
+		{
+			"functions without a return give nil",
+			`fun f() {} print f(); print f;`,
+			"nil\n<fn f>\n",
+		},
+		{
+			"classes",
+			`class Point { init(x, y) { this.x = x; this.y = y; } sum() { return this.x + this.y; } }
+			 var p = Point(1, 2); print p.sum(); p.x = 10; print p.sum(); print p; print Point;`,
+			"3\n12\nPoint instance\nPoint\n",
+		},
+		{
+			"bound methods remember this",
+			`class A { init() { this.v = "a"; } get() { return this.v; } } var m = A().get; print m();`,
+			"a\n",
+		},
+		{
+			"init returns this",
+			`class A { init() { this.v = 1; return; } } var a = A(); print a.init() == a;`,
+			"true\n",
+		},
+		{
+			"inheritance and super",
+			`class A { name() { return "A"; } hi() { return "hi from " + this.name(); } }
+			 class B < A { name() { return "B"; } hi() { return super.hi() + "!"; } }
+			 print B().hi();`,
+			"hi from B!\n",
+		},
+		{
+			"natives",
+			`print clock; var t = clock(); print t >= 0;`,
+			"<native fn clock>\ntrue\n",
+		},
+	}
+
+	for _, test := range tests {
+		stdout, stderr := interpret(t, test.source)
+		if stderr != "" {
+			t.Errorf("%s: unexpected errors: %s", test.name, stderr)
+		}
+
+		if stdout != test.want {
+			t.Errorf("%s: expected %q, got %q", test.name, test.want, stdout)
+		}
+	}
+}
+
+func TestInterpretRuntimeErrors(t *testing.T) {
+	tests := map[string]string{
+		`print "a" - 1;`:                            "Operands must be numbers.\n[line 1]",
+		`print 1 + nil;`:                            "Operands must be two numbers or two strings.\n[line 1]",
+		"\nprint -\"x\";":                           "Operand must be a number.\n[line 2]",
+		`print x;`:                                  "Undefined variable 'x'.",
+		`"not a function"();`:                       "Can only call functions and classes.",
+		`fun f(a) {} f(1, 2);`:                      "Expected 1 arguments but got 2.",
+		`class A {} A().nope;`:                      "Undefined property 'nope'.",
+		`var x = 1; x.y = 2;`:                       "Only instances have fields.",
+		`var NotAClass = 1; class B < NotAClass {}`: "Superclass must be a class.",
+	}
+
+	for source, want := range tests {
+		_, stderr := interpret(t, source)
+		if !hadRuntimeError || !strings.Contains(stderr, want) {
+			t.Errorf("%s: expected runtime error %q, got %q", source, want, stderr)
+		}
+	}
+
+	// a runtime error stops the program
+	stdout, _ := interpret(t, `print 1; print nil + 1; print 2;`)
+	if stdout != "1\n" {
+		t.Errorf("expected execution to stop at the error, got %q", stdout)
+	}
+}
+
+func TestClockCountsWholeSeconds(t *testing.T) {
+	clock, err := NewInterpreter().globals.Get(token.New(token.Identifier, "clock", nil, 1))
+	if err != nil {
+		t.Fatalf("get clock: %s", err)
+	}
+
+	value, _ := clock.(Callable).Call(nil, nil)
+	if seconds := value.(float64); seconds != math.Trunc(seconds) {
+		t.Errorf("expected whole seconds, like the VM, got %v", seconds)
+	}
+}
+
+// jlox is the reference for the VM, so the same program should print the
+// same thing in both.
+func TestMatchesVM(t *testing.T) {
+	source := `
+		class Counter {
+			init(step) { this.n = 0; this.step = step; }
+			incr() { this.n = this.n + this.step; return this; }
+		}
+
+		class Loud < Counter {
+			incr() { super.incr(); print "tick"; return this; }
+		}
+
+		fun makeAdder(x) {
+			fun add(y) { return x + y; }
+			return add;
+		}
+
+		var c = Loud(2);
+		c.incr().incr();
+		print c.n;
+		print makeAdder(1.5)(2);
+		print 7 / 2;
+		print -0;
+		print nil == false;
+		print Counter;
+		print c;
+		print makeAdder;
+		print clock;
+	`
+
+	stdout, stderr := interpret(t, source)
+	if stderr != "" {
+		t.Fatalf("jlox: %s", stderr)
+	}
+
+	var vmOut, vmErr bytes.Buffer
+	vm := lox.NewVM()
+	vm.SetStdout(&vmOut)
+	vm.SetStderr(&vmErr)
+
+	if err := vm.InterpretString(source); err != nil {
+		t.Fatalf("vm: %s\n%s", err, vmErr.String())
+	}
+
+	if stdout != vmOut.String() {
+		t.Errorf("jlox and the VM disagree:\njlox:\n%s\nvm:\n%s", stdout, vmOut.String())
+	}
+}
@@ -3,11 +3,21 @@ package jlox
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"log"
 	"os"
+
+	"github.com/mmcclimon/glox/jlox/token"
 )
 
 var hadError bool
+var hadRuntimeError bool
+
+// where errors get reported; tests point this somewhere they can read it
+var errorOutput io.Writer = os.Stderr
+
+// the REPL keeps its globals around between lines, so this is package-level
+var interpreter = NewInterpreter()
 
 func RunFile(filename string) {
 	bytes, err := os.ReadFile(filename)
@@ -21,6 +31,10 @@ func RunFile(filename string) {
 	if hadError {
 		os.Exit(65)
 	}
+
+	if hadRuntimeError {
+		os.Exit(70)
+	}
 }
 
 func REPL() {
@@ -44,16 +58,43 @@ func run(source string) {
 	scanner := NewScanner(source)
 	tokens := scanner.Tokens()
 
-	for _, tok := range tokens {
-		fmt.Println(tok)
+	parser := NewParser(tokens)
+	statements := parser.Parse()
+
+	// stop if there was a syntax error
+	if hadError {
+		return
 	}
+
+	resolver := NewResolver(interpreter)
+	resolver.Resolve(statements)
+
+	// stop if there was a resolution error
+	if hadError {
+		return
+	}
+
+	interpreter.Interpret(statements)
 }
 
 func Error(line int, message string) {
 	report(line, "", message)
 }
 
+func ErrorAt(tok token.Token, message string) {
+	if tok.Kind() == token.EOF {
+		report(tok.Line(), " at end", message)
+	} else {
+		report(tok.Line(), fmt.Sprintf(" at '%s'", tok.Lexeme()), message)
+	}
+}
+
+func runtimeError(err error) {
+	fmt.Fprintln(errorOutput, err)
+	hadRuntimeError = true
+}
+
 func report(line int, where, message string) {
-	fmt.Fprintf(os.Stderr, "[line %d] Error%s: %s\n", line, where, message)
+	fmt.Fprintf(errorOutput, "[line %d] Error%s: %s\n", line, where, message)
 	hadError = true
 }
@@ -0,0 +1,488 @@
+package jlox
+
+import (
+	"github.com/mmcclimon/glox/jlox/ast"
+	"github.com/mmcclimon/glox/jlox/token"
+)
+
+type Parser struct {
+	tokens  []token.Token
+	current int
+}
+
+// parseError is what we panic with when we hit a syntax error; declaration()
+// recovers from it and synchronizes, which is about the closest thing Go has
+// to the exceptions the book uses for this.
+type parseError struct{}
+
+func NewParser(tokens []token.Token) *Parser {
+	return &Parser{tokens: tokens}
+}
+
+func (p *Parser) Parse() []ast.Stmt {
+	statements := make([]ast.Stmt, 0)
+
+	for !p.isAtEnd() {
+		if stmt := p.declaration(); stmt != nil {
+			statements = append(statements, stmt)
+		}
+	}
+
+	return statements
+}
+
+func (p *Parser) declaration() (stmt ast.Stmt) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(parseError); !ok {
+				panic(r)
+			}
+
+			p.synchronize()
+			stmt = nil
+		}
+	}()
+
+	switch {
+	case p.match(token.Class):
+		return p.classDeclaration()
+	case p.match(token.Fun):
+		return p.function("function")
+	case p.match(token.Var):
+		return p.varDeclaration()
+	default:
+		return p.statement()
+	}
+}
+
+func (p *Parser) classDeclaration() ast.Stmt {
+	name := p.consume(token.Identifier, "Expect class name.")
+
+	var superclass *ast.Variable
+	if p.match(token.Less) {
+		p.consume(token.Identifier, "Expect superclass name.")
+		superclass = &ast.Variable{Name: p.previous()}
+	}
+
+	p.consume(token.LeftBrace, "Expect '{' before class body.")
+
+	methods := make([]*ast.Function, 0)
+	for !p.check(token.RightBrace) && !p.isAtEnd() {
+		methods = append(methods, p.function("method"))
+	}
+
+	p.consume(token.RightBrace, "Expect '}' after class body.")
+
+	return &ast.Class{Name: name, Superclass: superclass, Methods: methods}
+}
+
+func (p *Parser) function(kind string) *ast.Function {
+	name := p.consume(token.Identifier, "Expect "+kind+" name.")
+	p.consume(token.LeftParen, "Expect '(' after "+kind+" name.")
+
+	params := make([]token.Token, 0)
+	if !p.check(token.RightParen) {
+		for {
+			if len(params) >= 255 {
+				p.error(p.peek(), "Can't have more than 255 parameters.")
+			}
+
+			params = append(params, p.consume(token.Identifier, "Expect parameter name."))
+
+			if !p.match(token.Comma) {
+				break
+			}
+		}
+	}
+
+	p.consume(token.RightParen, "Expect ')' after parameters.")
+	p.consume(token.LeftBrace, "Expect '{' before "+kind+" body.")
+
+	body := p.block()
+	return &ast.Function{Name: name, Params: params, Body: body}
+}
+
+func (p *Parser) varDeclaration() ast.Stmt {
+	name := p.consume(token.Identifier, "Expect variable name.")
+
+	var initializer ast.Expr
+	if p.match(token.Equal) {
+		initializer = p.expression()
+	}
+
+	p.consume(token.Semicolon, "Expect ';' after variable declaration.")
+	return &ast.Var{Name: name, Initializer: initializer}
+}
+
+func (p *Parser) statement() ast.Stmt {
+	switch {
+	case p.match(token.For):
+		return p.forStatement()
+	case p.match(token.If):
+		return p.ifStatement()
+	case p.match(token.Print):
+		return p.printStatement()
+	case p.match(token.Return):
+		return p.returnStatement()
+	case p.match(token.While):
+		return p.whileStatement()
+	case p.match(token.LeftBrace):
+		return &ast.Block{Statements: p.block()}
+	default:
+		return p.expressionStatement()
+	}
+}
+
+// forStatement desugars into a while loop, so the interpreter never has to
+// know about for loops at all.
+func (p *Parser) forStatement() ast.Stmt {
+	p.consume(token.LeftParen, "Expect '(' after 'for'.")
+
+	var initializer ast.Stmt
+	switch {
+	case p.match(token.Semicolon):
+		// no initializer
+	case p.match(token.Var):
+		initializer = p.varDeclaration()
+	default:
+		initializer = p.expressionStatement()
+	}
+
+	var condition ast.Expr
+	if !p.check(token.Semicolon) {
+		condition = p.expression()
+	}
+	p.consume(token.Semicolon, "Expect ';' after loop condition.")
+
+	var increment ast.Expr
+	if !p.check(token.RightParen) {
+		increment = p.expression()
+	}
+	p.consume(token.RightParen, "Expect ')' after for clauses.")
+
+	body := p.statement()
+
+	if increment != nil {
+		body = &ast.Block{
+			Statements: []ast.Stmt{body, &ast.Expression{Expression: increment}},
+		}
+	}
+
+	if condition == nil {
+		condition = &ast.Literal{Value: true}
+	}
+
+	body = &ast.While{Condition: condition, Body: body}
+
+	if initializer != nil {
+		body = &ast.Block{Statements: []ast.Stmt{initializer, body}}
+	}
+
+	return body
+}
+
+func (p *Parser) ifStatement() ast.Stmt {
+	p.consume(token.LeftParen, "Expect '(' after 'if'.")
+	condition := p.expression()
+	p.consume(token.RightParen, "Expect ')' after if condition.")
+
+	thenBranch := p.statement()
+
+	var elseBranch ast.Stmt
+	if p.match(token.Else) {
+		elseBranch = p.statement()
+	}
+
+	return &ast.If{Condition: condition, ThenBranch: thenBranch, ElseBranch: elseBranch}
+}
+
+func (p *Parser) printStatement() ast.Stmt {
+	value := p.expression()
+	p.consume(token.Semicolon, "Expect ';' after value.")
+	return &ast.Print{Expression: value}
+}
+
+func (p *Parser) returnStatement() ast.Stmt {
+	keyword := p.previous()
+
+	var value ast.Expr
+	if !p.check(token.Semicolon) {
+		value = p.expression()
+	}
+
+	p.consume(token.Semicolon, "Expect ';' after return value.")
+	return &ast.Return{Keyword: keyword, Value: value}
+}
+
+func (p *Parser) whileStatement() ast.Stmt {
+	p.consume(token.LeftParen, "Expect '(' after 'while'.")
+	condition := p.expression()
+	p.consume(token.RightParen, "Expect ')' after condition.")
+
+	body := p.statement()
+	return &ast.While{Condition: condition, Body: body}
+}
+
+func (p *Parser) expressionStatement() ast.Stmt {
+	expr := p.expression()
+	p.consume(token.Semicolon, "Expect ';' after expression.")
+	return &ast.Expression{Expression: expr}
+}
+
+func (p *Parser) block() []ast.Stmt {
+	statements := make([]ast.Stmt, 0)
+
+	for !p.check(token.RightBrace) && !p.isAtEnd() {
+		if stmt := p.declaration(); stmt != nil {
+			statements = append(statements, stmt)
+		}
+	}
+
+	p.consume(token.RightBrace, "Expect '}' after block.")
+	return statements
+}
+
+// expressions, in increasing order of precedence
+func (p *Parser) expression() ast.Expr {
+	return p.assignment()
+}
+
+func (p *Parser) assignment() ast.Expr {
+	expr := p.or()
+
+	if p.match(token.Equal) {
+		equals := p.previous()
+		value := p.assignment()
+
+		switch target := expr.(type) {
+		case *ast.Variable:
+			return &ast.Assign{Name: target.Name, Value: value}
+		case *ast.Get:
+			return &ast.Set{Object: target.Object, Name: target.Name, Value: value}
+		}
+
+		// report, but don't panic; the parser isn't confused
+		p.error(equals, "Invalid assignment target.")
+	}
+
+	return expr
+}
+
+func (p *Parser) or() ast.Expr {
+	expr := p.and()
+
+	for p.match(token.Or) {
+		operator := p.previous()
+		right := p.and()
+		expr = &ast.Logical{Left: expr, Operator: operator, Right: right}
+	}
+
+	return expr
+}
+
+func (p *Parser) and() ast.Expr {
+	expr := p.equality()
+
+	for p.match(token.And) {
+		operator := p.previous()
+		right := p.equality()
+		expr = &ast.Logical{Left: expr, Operator: operator, Right: right}
+	}
+
+	return expr
+}
+
+func (p *Parser) equality() ast.Expr {
+	expr := p.comparison()
+
+	for p.match(token.BangEqual, token.EqualEqual) {
+		operator := p.previous()
+		right := p.comparison()
+		expr = &ast.Binary{Left: expr, Operator: operator, Right: right}
+	}
+
+	return expr
+}
+
+func (p *Parser) comparison() ast.Expr {
+	expr := p.term()
+
+	for p.match(token.Greater, token.GreaterEqual, token.Less, token.LessEqual) {
+		operator := p.previous()
+		right := p.term()
+		expr = &ast.Binary{Left: expr, Operator: operator, Right: right}
+	}
+
+	return expr
+}
+
+func (p *Parser) term() ast.Expr {
+	expr := p.factor()
+
+	for p.match(token.Minus, token.Plus) {
+		operator := p.previous()
+		right := p.factor()
+		expr = &ast.Binary{Left: expr, Operator: operator, Right: right}
+	}
+
+	return expr
+}
+
+func (p *Parser) factor() ast.Expr {
+	expr := p.unary()
+
+	for p.match(token.Slash, token.Star) {
+		operator := p.previous()
+		right := p.unary()
+		expr = &ast.Binary{Left: expr, Operator: operator, Right: right}
+	}
+
+	return expr
+}
+
+func (p *Parser) unary() ast.Expr {
+	if p.match(token.Bang, token.Minus) {
+		operator := p.previous()
+		right := p.unary()
+		return &ast.Unary{Operator: operator, Right: right}
+	}
+
+	return p.call()
+}
+
+func (p *Parser) call() ast.Expr {
+	expr := p.primary()
+
+	for {
+		if p.match(token.LeftParen) {
+			expr = p.finishCall(expr)
+		} else if p.match(token.Dot) {
+			name := p.consume(token.Identifier, "Expect property name after '.'.")
+			expr = &ast.Get{Object: expr, Name: name}
+		} else {
+			break
+		}
+	}
+
+	return expr
+}
+
+func (p *Parser) finishCall(callee ast.Expr) ast.Expr {
+	arguments := make([]ast.Expr, 0)
+
+	if !p.check(token.RightParen) {
+		for {
+			if len(arguments) >= 255 {
+				p.error(p.peek(), "Can't have more than 255 arguments.")
+			}
+
+			arguments = append(arguments, p.expression())
+
+			if !p.match(token.Comma) {
+				break
+			}
+		}
+	}
+
+	paren := p.consume(token.RightParen, "Expect ')' after arguments.")
+	return &ast.Call{Callee: callee, Paren: paren, Arguments: arguments}
+}
+
+func (p *Parser) primary() ast.Expr {
+	switch {
+	case p.match(token.False):
+		return &ast.Literal{Value: false}
+	case p.match(token.True):
+		return &ast.Literal{Value: true}
+	case p.match(token.Nil):
+		return &ast.Literal{Value: nil}
+	case p.match(token.Number, token.String):
+		return &ast.Literal{Value: p.previous().Literal()}
+	case p.match(token.Super):
+		keyword := p.previous()
+		p.consume(token.Dot, "Expect '.' after 'super'.")
+		method := p.consume(token.Identifier, "Expect superclass method name.")
+		return &ast.Super{Keyword: keyword, Method: method}
+	case p.match(token.This):
+		return &ast.This{Keyword: p.previous()}
+	case p.match(token.Identifier):
+		return &ast.Variable{Name: p.previous()}
+	case p.match(token.LeftParen):
+		expr := p.expression()
+		p.consume(token.RightParen, "Expect ')' after expression.")
+		return &ast.Grouping{Expression: expr}
+	}
+
+	panic(p.error(p.peek(), "Expect expression."))
+}
+
+// helpers
+func (p *Parser) match(kinds ...token.Type) bool {
+	for _, kind := range kinds {
+		if p.check(kind) {
+			p.advance()
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Parser) consume(kind token.Type, message string) token.Token {
+	if p.check(kind) {
+		return p.advance()
+	}
+
+	panic(p.error(p.peek(), message))
+}
+
+func (p *Parser) check(kind token.Type) bool {
+	if p.isAtEnd() {
+		return false
+	}
+
+	return p.peek().Kind() == kind
+}
+
+func (p *Parser) advance() token.Token {
+	if !p.isAtEnd() {
+		p.current++
+	}
+
+	return p.previous()
+}
+
+func (p *Parser) isAtEnd() bool {
+	return p.peek().Kind() == token.EOF
+}
+
+func (p *Parser) peek() token.Token {
+	return p.tokens[p.current]
+}
+
+func (p *Parser) previous() token.Token {
+	return p.tokens[p.current-1]
+}
+
+func (p *Parser) error(tok token.Token, message string) parseError {
+	ErrorAt(tok, message)
+	return parseError{}
+}
+
+func (p *Parser) synchronize() {
+	p.advance()
+
+	for !p.isAtEnd() {
+		if p.previous().Kind() == token.Semicolon {
+			return
+		}
+
+		switch p.peek().Kind() {
+		case token.Class, token.Fun, token.Var, token.For,
+			token.If, token.While, token.Print, token.Return:
+			return
+		}
+
+		p.advance()
+	}
+}
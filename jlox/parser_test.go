@@ -0,0 +1,198 @@
+package jlox
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mmcclimon/glox/jlox/ast"
+)
+
+// parse scans and parses source, returning the statements and whatever
+// errors got reported.
+func parse(t *testing.T, source string) ([]ast.Stmt, string) {
+	t.Helper()
+
+	var errors bytes.Buffer
+	errorOutput = &errors
+	hadError = false
+	t.Cleanup(func() { hadError = false })
+
+	statements := NewParser(NewScanner(source).Tokens()).Parse()
+	return statements, errors.String()
+}
+
+// sexp writes an expression out fully parenthesized, so tests can check
+// precedence and associativity at a glance.
+func sexp(expr ast.Expr) string {
+	switch e := expr.(type) {
+	case *ast.Assign:
+		return fmt.Sprintf("(= %s %s)", e.Name.Lexeme(), sexp(e.Value))
+	case *ast.Binary:
+		return fmt.Sprintf("(%s %s %s)", e.Operator.Lexeme(), sexp(e.Left), sexp(e.Right))
+	case *ast.Logical:
+		return fmt.Sprintf("(%s %s %s)", e.Operator.Lexeme(), sexp(e.Left), sexp(e.Right))
+	case *ast.Unary:
+		return fmt.Sprintf("(%s %s)", e.Operator.Lexeme(), sexp(e.Right))
+	case *ast.Grouping:
+		return fmt.Sprintf("(group %s)", sexp(e.Expression))
+	case *ast.Literal:
+		return stringify(e.Value)
+	case *ast.Variable:
+		return e.Name.Lexeme()
+	case *ast.Get:
+		return fmt.Sprintf("(. %s %s)", sexp(e.Object), e.Name.Lexeme())
+	case *ast.Set:
+		return fmt.Sprintf("(.= %s %s %s)", sexp(e.Object), e.Name.Lexeme(), sexp(e.Value))
+	case *ast.Call:
+		args := make([]string, len(e.Arguments))
+		for i, arg := range e.Arguments {
+			args[i] = sexp(arg)
+		}
+		return fmt.Sprintf("(call %s %s)", sexp(e.Callee), strings.Join(args, " "))
+	case *ast.This:
+		return "this"
+	case *ast.Super:
+		return "super." + e.Method.Lexeme()
+	default:
+		return fmt.Sprintf("?%T", expr)
+	}
+}
+
+func TestParseExpressions(t *testing.T) {
+	tests := map[string]string{
+		"1 + 2 * 3;":            "(+ 1 (* 2 3))",
+		"(1 + 2) * 3;":          "(* (group (+ 1 2)) 3)",
+		"1 - 2 - 3;":            "(- (- 1 2) 3)",
+		"-!x;":                  "(- (! x))",
+		"a == b < c;":           "(== a (< b c))",
+		"a or b and c;":         "(or a (and b c))",
+		"a = b = c;":            "(= a (= b c))",
+		"a.b.c = 1;":            "(.= (. a b) c 1)",
+		"f(1, 2)(3);":           "(call (call f 1 2) 3)",
+		"obj.method(x).field;":  "(. (call (. obj method) x) field)",
+		`"str" + nil == false;`: "(== (+ str nil) false)",
+	}
+
+	for source, want := range tests {
+		statements, errors := parse(t, source)
+		if errors != "" {
+			t.Errorf("%s: unexpected errors: %s", source, errors)
+			continue
+		}
+
+		stmt, ok := statements[0].(*ast.Expression)
+		if !ok || len(statements) != 1 {
+			t.Errorf("%s: expected one expression statement, got %#v", source, statements)
+			continue
+		}
+
+		if got := sexp(stmt.Expression); got != want {
+			t.Errorf("%s: expected %s, got %s", source, want, got)
+		}
+	}
+}
+
+func TestParseForDesugars(t *testing.T) {
+	statements, errors := parse(t, "for (var i = 0; i < 3; i = i + 1) print i;")
+	if errors != "" {
+		t.Fatalf("unexpected errors: %s", errors)
+	}
+
+	// { var i = 0; while (i < 3) { print i; i = i + 1; } }
+	outer, ok := statements[0].(*ast.Block)
+	if !ok || len(outer.Statements) != 2 {
+		t.Fatalf("expected a block with the initializer and loop, got %#v", statements[0])
+	}
+
+	if _, ok := outer.Statements[0].(*ast.Var); !ok {
+		t.Errorf("expected the initializer first, got %#v", outer.Statements[0])
+	}
+
+	loop, ok := outer.Statements[1].(*ast.While)
+	if !ok {
+		t.Fatalf("expected a while loop, got %#v", outer.Statements[1])
+	}
+
+	if got := sexp(loop.Condition); got != "(< i 3)" {
+		t.Errorf("expected condition (< i 3), got %s", got)
+	}
+
+	body, ok := loop.Body.(*ast.Block)
+	if !ok || len(body.Statements) != 2 {
+		t.Fatalf("expected the body and increment in a block, got %#v", loop.Body)
+	}
+
+	if increment, ok := body.Statements[1].(*ast.Expression); !ok || sexp(increment.Expression) != "(= i (+ i 1))" {
+		t.Errorf("expected the increment last, got %#v", body.Statements[1])
+	}
+
+	// with no clauses at all, it's just an infinite while loop
+	statements, _ = parse(t, "for (;;) print 1;")
+	if loop, ok := statements[0].(*ast.While); !ok || sexp(loop.Condition) != "true" {
+		t.Errorf("expected while (true), got %#v", statements[0])
+	}
+}
+
+func TestParseClass(t *testing.T) {
+	statements, errors := parse(t, `
+		class B < A {
+			init(x) { this.x = x; }
+			get() { return super.get() + this.x; }
+		}
+	`)
+	if errors != "" {
+		t.Fatalf("unexpected errors: %s", errors)
+	}
+
+	class, ok := statements[0].(*ast.Class)
+	if !ok {
+		t.Fatalf("expected a class, got %#v", statements[0])
+	}
+
+	if class.Name.Lexeme() != "B" || class.Superclass == nil || class.Superclass.Name.Lexeme() != "A" {
+		t.Errorf("expected class B < A, got %s < %v", class.Name.Lexeme(), class.Superclass)
+	}
+
+	if len(class.Methods) != 2 || class.Methods[0].Name.Lexeme() != "init" || len(class.Methods[0].Params) != 1 {
+		t.Errorf("expected methods init(x) and get(), got %#v", class.Methods)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]string{
+		"1 + 2 = 3;":        "[line 1] Error at '=': Invalid assignment target.",
+		"var;":              "[line 1] Error at ';': Expect variable name.",
+		"print 1":           "[line 1] Error at end: Expect ';' after value.",
+		"class { }":         "[line 1] Error at '{': Expect class name.",
+		"fun f(a { }":       "[line 1] Error at '{': Expect ')' after parameters.",
+		"if x) print 1;":    "[line 1] Error at 'x': Expect '(' after 'if'.",
+		"(1 + 2;":           "[line 1] Error at ';': Expect ')' after expression.",
+		"for (var i = 0) ;": "[line 1] Error at ')': Expect ';' after variable declaration.",
+	}
+
+	for source, want := range tests {
+		_, errors := parse(t, source)
+		if !hadError || !strings.Contains(errors, want) {
+			t.Errorf("%s: expected error %q, got %q", source, want, errors)
+		}
+	}
+}
+
+func TestParseSynchronizes(t *testing.T) {
+	// each bad statement is reported, and the good one between them survives
+	statements, errors := parse(t, "var = 1;\nprint 2;\nvar = 3;\n")
+
+	if lines := strings.Count(errors, "\n"); lines != 2 {
+		t.Errorf("expected 2 errors, got %q", errors)
+	}
+
+	if len(statements) != 1 {
+		t.Fatalf("expected the good statement to be kept, got %#v", statements)
+	}
+
+	if _, ok := statements[0].(*ast.Print); !ok {
+		t.Errorf("expected a print statement, got %#v", statements[0])
+	}
+}
@@ -0,0 +1,261 @@
+package jlox
+
+import (
+	"github.com/mmcclimon/glox/jlox/ast"
+	"github.com/mmcclimon/glox/jlox/token"
+)
+
+// Resolver walks the AST once before we run it, figuring out how many
+// environments away each local variable lives. Anything it can't find in a
+// scope is assumed to be global.
+type Resolver struct {
+	interpreter     *Interpreter
+	scopes          []map[string]bool
+	currentFunction functionType
+	currentClass    classType
+}
+
+type functionType int
+type classType int
+
+const (
+	functionNone functionType = iota
+	functionFunction
+	functionInitializer
+	functionMethod
+)
+
+const (
+	classNone classType = iota
+	classClass
+	classSubclass
+)
+
+func NewResolver(interpreter *Interpreter) *Resolver {
+	return &Resolver{
+		interpreter: interpreter,
+		scopes:      make([]map[string]bool, 0),
+	}
+}
+
+func (r *Resolver) Resolve(statements []ast.Stmt) {
+	for _, stmt := range statements {
+		r.resolveStmt(stmt)
+	}
+}
+
+func (r *Resolver) resolveStmt(stmt ast.Stmt) {
+	switch s := stmt.(type) {
+	case *ast.Block:
+		r.beginScope()
+		r.Resolve(s.Statements)
+		r.endScope()
+
+	case *ast.Class:
+		r.resolveClass(s)
+
+	case *ast.Expression:
+		r.resolveExpr(s.Expression)
+
+	case *ast.Function:
+		r.declare(s.Name)
+		r.define(s.Name)
+		r.resolveFunction(s, functionFunction)
+
+	case *ast.If:
+		r.resolveExpr(s.Condition)
+		r.resolveStmt(s.ThenBranch)
+		if s.ElseBranch != nil {
+			r.resolveStmt(s.ElseBranch)
+		}
+
+	case *ast.Print:
+		r.resolveExpr(s.Expression)
+
+	case *ast.Return:
+		if r.currentFunction == functionNone {
+			ErrorAt(s.Keyword, "Can't return from top-level code.")
+		}
+
+		if s.Value != nil {
+			if r.currentFunction == functionInitializer {
+				ErrorAt(s.Keyword, "Can't return a value from an initializer.")
+			}
+
+			r.resolveExpr(s.Value)
+		}
+
+	case *ast.Var:
+		r.declare(s.Name)
+		if s.Initializer != nil {
+			r.resolveExpr(s.Initializer)
+		}
+		r.define(s.Name)
+
+	case *ast.While:
+		r.resolveExpr(s.Condition)
+		r.resolveStmt(s.Body)
+	}
+}
+
+func (r *Resolver) resolveClass(stmt *ast.Class) {
+	enclosingClass := r.currentClass
+	r.currentClass = classClass
+	defer func() { r.currentClass = enclosingClass }()
+
+	r.declare(stmt.Name)
+	r.define(stmt.Name)
+
+	if stmt.Superclass != nil {
+		if stmt.Name.Lexeme() == stmt.Superclass.Name.Lexeme() {
+			ErrorAt(stmt.Superclass.Name, "A class can't inherit from itself.")
+		}
+
+		r.currentClass = classSubclass
+		r.resolveExpr(stmt.Superclass)
+
+		r.beginScope()
+		r.peekScope()["super"] = true
+	}
+
+	r.beginScope()
+	r.peekScope()["this"] = true
+
+	for _, method := range stmt.Methods {
+		kind := functionMethod
+		if method.Name.Lexeme() == "init" {
+			kind = functionInitializer
+		}
+
+		r.resolveFunction(method, kind)
+	}
+
+	r.endScope()
+
+	if stmt.Superclass != nil {
+		r.endScope()
+	}
+}
+
+func (r *Resolver) resolveFunction(function *ast.Function, kind functionType) {
+	enclosingFunction := r.currentFunction
+	r.currentFunction = kind
+
+	r.beginScope()
+	for _, param := range function.Params {
+		r.declare(param)
+		r.define(param)
+	}
+	r.Resolve(function.Body)
+	r.endScope()
+
+	r.currentFunction = enclosingFunction
+}
+
+func (r *Resolver) resolveExpr(expr ast.Expr) {
+	switch e := expr.(type) {
+	case *ast.Assign:
+		r.resolveExpr(e.Value)
+		r.resolveLocal(e, e.Name)
+
+	case *ast.Binary:
+		r.resolveExpr(e.Left)
+		r.resolveExpr(e.Right)
+
+	case *ast.Call:
+		r.resolveExpr(e.Callee)
+		for _, argument := range e.Arguments {
+			r.resolveExpr(argument)
+		}
+
+	case *ast.Get:
+		r.resolveExpr(e.Object)
+
+	case *ast.Grouping:
+		r.resolveExpr(e.Expression)
+
+	case *ast.Literal:
+		// nothing to do
+
+	case *ast.Logical:
+		r.resolveExpr(e.Left)
+		r.resolveExpr(e.Right)
+
+	case *ast.Set:
+		r.resolveExpr(e.Value)
+		r.resolveExpr(e.Object)
+
+	case *ast.Super:
+		if r.currentClass == classNone {
+			ErrorAt(e.Keyword, "Can't use 'super' outside of a class.")
+		} else if r.currentClass != classSubclass {
+			ErrorAt(e.Keyword, "Can't use 'super' in a class with no superclass.")
+		}
+
+		r.resolveLocal(e, e.Keyword)
+
+	case *ast.This:
+		if r.currentClass == classNone {
+			ErrorAt(e.Keyword, "Can't use 'this' outside of a class.")
+			return
+		}
+
+		r.resolveLocal(e, e.Keyword)
+
+	case *ast.Unary:
+		r.resolveExpr(e.Right)
+
+	case *ast.Variable:
+		if len(r.scopes) > 0 {
+			if defined, declared := r.peekScope()[e.Name.Lexeme()]; declared && !defined {
+				ErrorAt(e.Name, "Can't read local variable in its own initializer.")
+			}
+		}
+
+		r.resolveLocal(e, e.Name)
+	}
+}
+
+// resolveLocal tells the interpreter how many scopes out the variable lives;
+// if we don't find it, we leave it unresolved and it's assumed to be global.
+func (r *Resolver) resolveLocal(expr ast.Expr, name token.Token) {
+	for i := len(r.scopes) - 1; i >= 0; i-- {
+		if _, ok := r.scopes[i][name.Lexeme()]; ok {
+			r.interpreter.resolve(expr, len(r.scopes)-1-i)
+			return
+		}
+	}
+}
+
+func (r *Resolver) declare(name token.Token) {
+	if len(r.scopes) == 0 {
+		return
+	}
+
+	scope := r.peekScope()
+	if _, ok := scope[name.Lexeme()]; ok {
+		ErrorAt(name, "Already a variable with this name in this scope.")
+	}
+
+	scope[name.Lexeme()] = false
+}
+
+func (r *Resolver) define(name token.Token) {
+	if len(r.scopes) == 0 {
+		return
+	}
+
+	r.peekScope()[name.Lexeme()] = true
+}
+
+func (r *Resolver) beginScope() {
+	r.scopes = append(r.scopes, make(map[string]bool))
+}
+
+func (r *Resolver) endScope() {
+	r.scopes = r.scopes[:len(r.scopes)-1]
+}
+
+func (r *Resolver) peekScope() map[string]bool {
+	return r.scopes[len(r.scopes)-1]
+}
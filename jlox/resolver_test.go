@@ -0,0 +1,108 @@
+package jlox
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mmcclimon/glox/jlox/ast"
+)
+
+func TestResolverErrors(t *testing.T) {
+	tests := map[string]string{
+		"{ var a = a; }":                        "Error at 'a': Can't read local variable in its own initializer.",
+		"return 1;":                             "Error at 'return': Can't return from top-level code.",
+		"class A { init() { return 1; } }":      "Error at 'return': Can't return a value from an initializer.",
+		"{ var a = 1; var a = 2; }":             "Error at 'a': Already a variable with this name in this scope.",
+		"fun f(a, a) {}":                        "Error at 'a': Already a variable with this name in this scope.",
+		"print this;":                           "Error at 'this': Can't use 'this' outside of a class.",
+		"fun f() { return this; }":              "Error at 'this': Can't use 'this' outside of a class.",
+		"print super.x;":                        "Error at 'super': Can't use 'super' outside of a class.",
+		"class A { f() { return super.f(); } }": "Error at 'super': Can't use 'super' in a class with no superclass.",
+		"class A < A {}":                        "Error at 'A': A class can't inherit from itself.",
+	}
+
+	for source, want := range tests {
+		stdout, stderr := interpret(t, source+` print "ran";`)
+		if !hadError || !strings.Contains(stderr, want) {
+			t.Errorf("%s: expected error %q, got %q", source, want, stderr)
+		}
+
+		if stdout != "" {
+			t.Errorf("%s: expected nothing to run after a resolution error, got %q", source, stdout)
+		}
+	}
+}
+
+func TestResolverAllows(t *testing.T) {
+	// these look like the errors above, but are fine
+	sources := []string{
+		"var a = 1; var a = 2;",               // globals can be redeclared
+		"var a = 1; { var b = a; }",           // reading an outer variable
+		"fun f() { return; } f();",            // returning from a function
+		"class A { init() { return; } } A();", // an empty return in an initializer
+		"class A {} class B < A { f() { return super.f; } }",
+	}
+
+	for _, source := range sources {
+		if _, stderr := interpret(t, source); stderr != "" {
+			t.Errorf("%s: unexpected error %q", source, stderr)
+		}
+	}
+}
+
+func TestResolverBindsStatically(t *testing.T) {
+	// showA closes over the global a, and a later local a in the same block
+	// doesn't change that
+	stdout, stderr := interpret(t, `
+		var a = "global";
+		{
+			fun showA() { print a; }
+			showA();
+			var a = "block";
+			showA();
+			print a;
+		}
+	`)
+	if stderr != "" {
+		t.Fatalf("unexpected errors: %s", stderr)
+	}
+
+	if want := "global\nglobal\nblock\n"; stdout != want {
+		t.Errorf("expected %q, got %q", want, stdout)
+	}
+}
+
+func TestResolverDistances(t *testing.T) {
+	statements, errors := parse(t, `
+		var g = 0;
+		fun outer(x) {
+			var y = 1;
+			fun inner() {
+				{ print x + y + g; }
+			}
+		}
+	`)
+	if errors != "" {
+		t.Fatalf("unexpected errors: %s", errors)
+	}
+
+	interpreter := NewInterpreter()
+	NewResolver(interpreter).Resolve(statements)
+
+	depths := make(map[string]int)
+	for expr, depth := range interpreter.locals {
+		if v, ok := expr.(*ast.Variable); ok {
+			depths[v.Name.Lexeme()] = depth
+		}
+	}
+
+	// from inside the block in inner: the block, inner's body, then outer's
+	// body, where both x and y live
+	if depths["x"] != 2 || depths["y"] != 2 {
+		t.Errorf("expected x and y at distance 2, got %v", depths)
+	}
+
+	if _, ok := depths["g"]; ok {
+		t.Errorf("expected the global g to be left unresolved, got %v", depths)
+	}
+}
@@ -18,3 +18,19 @@ func New(kind Type, lexeme string, literal any, line int) Token {
 func (t Token) String() string {
 	return fmt.Sprintf("%4d %-16s %-10s", t.line, t.kind, t.lexeme)
 }
+
+func (t Token) Kind() Type {
+	return t.kind
+}
+
+func (t Token) Lexeme() string {
+	return t.lexeme
+}
+
+func (t Token) Literal() any {
+	return t.literal
+}
+
+func (t Token) Line() int {
+	return t.line
+}
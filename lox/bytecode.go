@@ -0,0 +1,331 @@
+package lox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// The on-disk format is pretty simple. After the header, a function is:
+//
+//	name          string
+//	arity         uvarint
+//	upvalueCount  uvarint
+//	code          uvarint length, then raw bytes
+//	lines         uvarint count, then that many uvarints
+//	constants     uvarint count, then a tag byte and payload for each
+//
+// where strings are a uvarint length followed by their bytes. Nested
+// functions are just written inline as constants.
+const BYTECODE_VERSION = 1
+
+var BytecodeMagic = []byte("LOXC")
+
+var ErrBadBytecode = errors.New("invalid bytecode")
+
+const (
+	tagNumber byte = iota + 1
+	tagString
+	tagFunction
+)
+
+// this is plenty for any reasonable program, and stops a malicious file from
+// blowing the Go stack while we recurse through nested functions
+const maxFunctionNesting = 256
+
+func IsBytecode(data []byte) bool {
+	return bytes.HasPrefix(data, BytecodeMagic)
+}
+
+func WriteBytecode(w io.Writer, function ValueFunction) error {
+	enc := &encoder{}
+	enc.buf.Write(BytecodeMagic)
+	enc.buf.Write(binary.BigEndian.AppendUint16(nil, BYTECODE_VERSION))
+
+	if err := enc.function(&function); err != nil {
+		return err
+	}
+
+	_, err := w.Write(enc.buf.Bytes())
+	return err
+}
+
+// ReadBytecode loads a function written by WriteBytecode, and runs Verify on
+// it, so whatever it returns is safe to hand to Interpret.
+func ReadBytecode(r io.Reader) (ValueFunction, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return ValueFunction{}, err
+	}
+
+	if !IsBytecode(data) {
+		return ValueFunction{}, fmt.Errorf("%w: missing header", ErrBadBytecode)
+	}
+
+	dec := &decoder{data: data, pos: len(BytecodeMagic)}
+
+	version, err := dec.uint16()
+	if err != nil {
+		return ValueFunction{}, err
+	}
+
+	if version != BYTECODE_VERSION {
+		return ValueFunction{}, fmt.Errorf("%w: unsupported version %d (want %d)",
+			ErrBadBytecode, version, BYTECODE_VERSION)
+	}
+
+	function, err := dec.function(0)
+	if err != nil {
+		return ValueFunction{}, err
+	}
+
+	if dec.pos != len(dec.data) {
+		return ValueFunction{}, dec.errorf("trailing data")
+	}
+
+	if err := Verify(*function); err != nil {
+		return ValueFunction{}, err
+	}
+
+	return *function, nil
+}
+
+// writing
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) uvarint(n int) {
+	e.buf.Write(binary.AppendUvarint(nil, uint64(n)))
+}
+
+func (e *encoder) string(s string) {
+	e.uvarint(len(s))
+	e.buf.WriteString(s)
+}
+
+func (e *encoder) function(function *ValueFunction) error {
+	chunk := function.chunk
+
+	e.string(function.name)
+	e.uvarint(function.arity)
+	e.uvarint(function.upvalueCount)
+
+	e.uvarint(len(chunk.code))
+	e.buf.Write(chunk.code)
+
+	e.uvarint(len(chunk.lines))
+	for _, n := range chunk.lines {
+		e.uvarint(n)
+	}
+
+	e.uvarint(len(*chunk.constants))
+	for _, constant := range *chunk.constants {
+		switch v := constant.(type) {
+		case ValueNumber:
+			e.buf.WriteByte(tagNumber)
+			e.buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(float64(v))))
+		case ValueString:
+			e.buf.WriteByte(tagString)
+			e.string(string(v))
+		case ValueFunction:
+			e.buf.WriteByte(tagFunction)
+			if err := e.function(&v); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("cannot serialize constant of type %T", constant)
+		}
+	}
+
+	return nil
+}
+
+// reading
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *decoder) errorf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s at byte %d", ErrBadBytecode, fmt.Sprintf(format, args...), d.pos)
+}
+
+func (d *decoder) remaining() int {
+	return len(d.data) - d.pos
+}
+
+func (d *decoder) byte() (byte, error) {
+	if d.remaining() < 1 {
+		return 0, d.errorf("unexpected end of data")
+	}
+
+	d.pos++
+	return d.data[d.pos-1], nil
+}
+
+func (d *decoder) bytes(n int) ([]byte, error) {
+	if n < 0 || d.remaining() < n {
+		return nil, d.errorf("length %d out of bounds", n)
+	}
+
+	d.pos += n
+	return d.data[d.pos-n : d.pos], nil
+}
+
+func (d *decoder) uint16() (uint16, error) {
+	b, err := d.bytes(2)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint16(b), nil
+}
+
+// uvarint reads a varint, and insists that it's no bigger than max
+func (d *decoder) uvarint(max int) (int, error) {
+	n, size := binary.Uvarint(d.data[d.pos:])
+	if size <= 0 {
+		return 0, d.errorf("bad varint")
+	}
+
+	if n > uint64(max) {
+		return 0, d.errorf("value %d out of range", n)
+	}
+
+	d.pos += size
+	return int(n), nil
+}
+
+func (d *decoder) string() (string, error) {
+	n, err := d.uvarint(d.remaining())
+	if err != nil {
+		return "", err
+	}
+
+	b, err := d.bytes(n)
+	return string(b), err
+}
+
+func (d *decoder) function(depth int) (*ValueFunction, error) {
+	if depth > maxFunctionNesting {
+		return nil, d.errorf("functions nested too deeply")
+	}
+
+	var err error
+	function := NewFunction()
+	chunk := function.chunk
+
+	if function.name, err = d.string(); err != nil {
+		return nil, err
+	}
+
+	if function.arity, err = d.uvarint(math.MaxUint8); err != nil {
+		return nil, err
+	}
+
+	if function.upvalueCount, err = d.uvarint(UINT8_COUNT); err != nil {
+		return nil, err
+	}
+
+	codeLen, err := d.uvarint(d.remaining())
+	if err != nil {
+		return nil, err
+	}
+
+	code, err := d.bytes(codeLen)
+	if err != nil {
+		return nil, err
+	}
+	chunk.code = append(chunk.code, code...)
+
+	if err := d.lines(chunk); err != nil {
+		return nil, err
+	}
+
+	// every constant takes at least two bytes, which bounds the count
+	constantCount, err := d.uvarint(d.remaining() / 2)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < constantCount; i++ {
+		tag, err := d.byte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch tag {
+		case tagNumber:
+			b, err := d.bytes(8)
+			if err != nil {
+				return nil, err
+			}
+
+			chunk.constants.Write(ValueNumber(math.Float64frombits(binary.BigEndian.Uint64(b))))
+
+		case tagString:
+			s, err := d.string()
+			if err != nil {
+				return nil, err
+			}
+
+			chunk.constants.Write(ValueString(s))
+
+		case tagFunction:
+			nested, err := d.function(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+
+			chunk.constants.Write(*nested)
+
+		default:
+			return nil, d.errorf("unknown constant tag %d", tag)
+		}
+	}
+
+	return function, nil
+}
+
+// lines reads the run-length line table, and checks that it's well-formed
+// enough that GetLine can find every offset in the code.
+func (d *decoder) lines(chunk *Chunk) error {
+	count, err := d.uvarint(d.remaining())
+	if err != nil {
+		return err
+	}
+
+	if count%2 != 0 {
+		return d.errorf("odd-length line table")
+	}
+
+	prevOffset := -1
+	for i := 0; i < count; i += 2 {
+		line, err := d.uvarint(math.MaxInt32)
+		if err != nil {
+			return err
+		}
+
+		offset, err := d.uvarint(math.MaxInt32)
+		if err != nil {
+			return err
+		}
+
+		if offset < prevOffset {
+			return d.errorf("line table offsets out of order")
+		}
+
+		prevOffset = offset
+		chunk.lines = append(chunk.lines, line, offset)
+	}
+
+	if len(chunk.code) > 0 && prevOffset < len(chunk.code)-1 {
+		return d.errorf("line table does not cover code")
+	}
+
+	return nil
+}
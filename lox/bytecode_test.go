@@ -0,0 +1,180 @@
+package lox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+const corruptionSource = `
+class Shape {
+	init(name) { this.name = name; }
+	describe() { return "a " + this.name; }
+}
+
+class Square < Shape {
+	init(side) {
+		super.init("square");
+		this.side = side;
+	}
+	describe() { return super.describe() + " of side " + str(this.side); }
+}
+
+fun makeAdder(n) {
+	fun add(x) { return x + n; }
+	return add;
+}
+
+var sq = Square(3);
+var add2 = makeAdder(2);
+var items = [1, 2, 3];
+var totals = {"sum": 0};
+for (var i in items) {
+	totals["sum"] = add2(totals["sum"] + i);
+}
+
+switch (sq.side) {
+	case 3: print sq.describe();
+	default: print "?";
+}
+print totals;
+`
+
+// assemble builds a top-level function straight from bytes, skipping the
+// compiler, so we can make bytecode it would never produce.
+func assemble(code []byte, constants ...Value) ValueFunction {
+	function := NewFunction()
+	for _, constant := range constants {
+		function.chunk.AddConstant(constant)
+	}
+	for _, b := range code {
+		function.chunk.Write(b, 1)
+	}
+
+	return *function
+}
+
+func TestReadBytecodeRejectsBadFiles(t *testing.T) {
+	good := compileToBytes(t, corruptionSource)
+
+	withVersion := append([]byte{}, good...)
+	withVersion[len(BytecodeMagic)+1]++
+
+	tests := map[string][]byte{
+		"empty":         {},
+		"missing magic": good[len(BytecodeMagic):],
+		"bad version":   withVersion,
+		"truncated":     good[:len(good)/2],
+		"trailing data": append(append([]byte{}, good...), 0),
+	}
+
+	for name, data := range tests {
+		_, err := ReadBytecode(bytes.NewReader(data))
+		if !errors.Is(err, ErrBadBytecode) {
+			t.Errorf("%s: expected ErrBadBytecode, got %v", name, err)
+		}
+	}
+}
+
+func TestReadBytecodeVerifies(t *testing.T) {
+	tests := map[string]ValueFunction{
+		"unknown opcode":         assemble([]byte{255, byte(OP_NIL), byte(OP_RETURN)}),
+		"constant out of range":  assemble([]byte{byte(OP_CONSTANT), 3, byte(OP_RETURN)}),
+		"jump past the end":      assemble([]byte{byte(OP_JUMP), 0, 200, byte(OP_NIL), byte(OP_RETURN)}),
+		"stack underflow":        assemble([]byte{byte(OP_POP), byte(OP_NIL), byte(OP_RETURN)}),
+		"bad local slot":         assemble([]byte{byte(OP_GET_LOCAL), 9, byte(OP_RETURN)}),
+		"global name not string": assemble([]byte{byte(OP_GET_GLOBAL), 0, byte(OP_RETURN)}, ValueNumber(1)),
+		"falls off the end":      assemble([]byte{byte(OP_NIL)}),
+	}
+
+	for name, function := range tests {
+		var buf bytes.Buffer
+		if err := WriteBytecode(&buf, function); err != nil {
+			t.Fatalf("%s: writing bytecode: %s", name, err)
+		}
+
+		_, err := ReadBytecode(&buf)
+
+		var verifyErr *VerifyError
+		if !errors.As(err, &verifyErr) || !errors.Is(err, ErrBadBytecode) {
+			t.Errorf("%s: expected a *VerifyError, got %v", name, err)
+		}
+	}
+}
+
+// Verify only checks that the stack has the right shape, not what's in it, so
+// the VM still has to check the types of things it pulls off the stack.
+func TestVerifiedBytecodeWithWrongTypes(t *testing.T) {
+	tests := map[string]ValueFunction{
+		"get super from non-class": assemble([]byte{
+			byte(OP_NIL), byte(OP_NIL), byte(OP_GET_SUPER), 0, byte(OP_RETURN),
+		}, ValueString("m")),
+		"super invoke on non-class": assemble([]byte{
+			byte(OP_NIL), byte(OP_NIL), byte(OP_SUPER_INVOKE), 0, 0, byte(OP_RETURN),
+		}, ValueString("m")),
+		"inherit into non-class": assemble([]byte{
+			byte(OP_CLASS), 0, byte(OP_NIL), byte(OP_INHERIT), byte(OP_RETURN),
+		}, ValueString("A")),
+		"method on non-class": assemble([]byte{
+			byte(OP_NIL), byte(OP_NIL), byte(OP_METHOD), 0, byte(OP_RETURN),
+		}, ValueString("m")),
+		"method that isn't a function": assemble([]byte{
+			byte(OP_CLASS), 0, byte(OP_NIL), byte(OP_METHOD), 1, byte(OP_RETURN),
+		}, ValueString("A"), ValueString("m")),
+	}
+
+	for name, function := range tests {
+		if err := Verify(function); err != nil {
+			t.Fatalf("%s: expected bytecode to verify, got %s", name, err)
+		}
+
+		vm := NewVM()
+		vm.SetStderr(io.Discard)
+
+		var runtimeErr *RuntimeError
+		if err := vm.Interpret(function); !errors.As(err, &runtimeErr) {
+			t.Errorf("%s: expected a *RuntimeError, got %v", name, err)
+		}
+	}
+}
+
+// Flipping bytes all over a real program should only ever get us an error,
+// from either the loader or the VM, and never a panic.
+func TestCorruptBytecodeDoesNotPanic(t *testing.T) {
+	good := compileToBytes(t, corruptionSource)
+
+	for pos := len(BytecodeMagic) + 2; pos < len(good); pos++ {
+		for _, mask := range []byte{0x01, 0x10, 0x80, 0xff} {
+			data := append([]byte{}, good...)
+			data[pos] ^= mask
+
+			if err := runCorrupted(data); err != nil {
+				t.Fatalf("byte %d ^ %#02x: %s", pos, mask, err)
+			}
+		}
+	}
+}
+
+func runCorrupted(data []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	function, loadErr := ReadBytecode(bytes.NewReader(data))
+	if loadErr != nil {
+		return nil
+	}
+
+	vm := NewVM()
+	vm.SetStdout(io.Discard)
+	vm.SetStderr(io.Discard)
+	vm.SetInstructionLimit(100_000)
+	vm.SetMemoryLimit(1 << 20)
+
+	vm.Interpret(function)
+	return nil
+}
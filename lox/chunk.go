@@ -1,16 +1,23 @@
 package lox
 
+import "math"
+
 type OpCode byte
 
 type Chunk struct {
 	code      []byte
 	constants *ValueArray
 	lines     lines
+
+	// lookup tables so that AddConstant can reuse slots for identical values
+	numberIndex map[uint64]int
+	stringIndex map[ValueString]int
 }
 
 const (
 	OP_UNKNOWN OpCode = iota
 	OP_CONSTANT
+	OP_CONSTANT_LONG
 	OP_NIL
 	OP_TRUE
 	OP_FALSE
@@ -18,8 +25,19 @@ const (
 	OP_DEFINE_GLOBAL
 	OP_GET_GLOBAL
 	OP_SET_GLOBAL
+	OP_DEFINE_GLOBAL_LONG
+	OP_GET_GLOBAL_LONG
+	OP_SET_GLOBAL_LONG
 	OP_GET_LOCAL
 	OP_SET_LOCAL
+	OP_GET_UPVALUE
+	OP_SET_UPVALUE
+	OP_GET_PROPERTY
+	OP_SET_PROPERTY
+	OP_GET_SUPER
+	OP_GET_PROPERTY_LONG
+	OP_SET_PROPERTY_LONG
+	OP_GET_SUPER_LONG
 	OP_EQUAL
 	OP_GREATER
 	OP_LESS
@@ -35,14 +53,37 @@ const (
 	OP_JUMP_IF_TRUE
 	OP_LOOP
 	OP_CALL
+	OP_INVOKE
+	OP_SUPER_INVOKE
+	OP_INVOKE_LONG
+	OP_SUPER_INVOKE_LONG
+	OP_CLOSURE
+	OP_CLOSURE_LONG
+	OP_CLOSE_UPVALUE
 	OP_RETURN
+	OP_CLASS
+	OP_INHERIT
+	OP_METHOD
+	OP_CLASS_LONG
+	OP_METHOD_LONG
+	OP_BUILD_LIST
+	OP_BUILD_MAP
+	OP_INDEX_GET
+	OP_INDEX_SET
+	OP_ITER
+	OP_ITER_NEXT
 )
 
 var opNames map[OpCode]string
 
 func NewChunk() *Chunk {
 	code := make([]byte, 0, 8)
-	return &Chunk{code: code, constants: NewValueArray()}
+	return &Chunk{
+		code:        code,
+		constants:   NewValueArray(),
+		numberIndex: make(map[uint64]int),
+		stringIndex: make(map[ValueString]int),
+	}
 }
 
 func (c *Chunk) Write(item byte, line int) {
@@ -50,12 +91,39 @@ func (c *Chunk) Write(item byte, line int) {
 	c.code = append(c.code, item)
 }
 
+// AddConstant returns the index of the value in the constant pool, adding it
+// only if there isn't already an identical number or string there. (Numbers
+// are keyed on their bits so that 0 and -0 don't get conflated.)
 func (c *Chunk) AddConstant(item Value) int {
+	switch v := item.(type) {
+	case ValueNumber:
+		bits := math.Float64bits(float64(v))
+		if index, ok := c.numberIndex[bits]; ok {
+			return index
+		}
+
+		c.numberIndex[bits] = c.appendConstant(item)
+		return c.numberIndex[bits]
+
+	case ValueString:
+		if index, ok := c.stringIndex[v]; ok {
+			return index
+		}
+
+		c.stringIndex[v] = c.appendConstant(item)
+		return c.stringIndex[v]
+
+	default:
+		return c.appendConstant(item)
+	}
+}
+
+func (c *Chunk) appendConstant(item Value) int {
 	c.constants.Write(item)
 	return len(*c.constants) - 1
 }
 
-func (c *Chunk) constantAt(offset byte) Value {
+func (c *Chunk) constantAt(offset int) Value {
 	return (*c.constants)[offset]
 }
 
@@ -100,32 +168,62 @@ func (l *lines) getForOffset(offset int) int {
 
 func init() {
 	opNames = map[OpCode]string{
-		OP_CONSTANT:      "OP_CONSTANT",
-		OP_NIL:           "OP_NIL",
-		OP_TRUE:          "OP_TRUE",
-		OP_FALSE:         "OP_FALSE",
-		OP_POP:           "OP_POP",
-		OP_DEFINE_GLOBAL: "OP_DEFINE_GLOBAL",
-		OP_GET_GLOBAL:    "OP_GET_GLOBAL",
-		OP_SET_GLOBAL:    "OP_SET_GLOBAL",
-		OP_GET_LOCAL:     "OP_GET_LOCAL",
-		OP_SET_LOCAL:     "OP_SET_LOCAL",
-		OP_EQUAL:         "OP_EQUAL",
-		OP_GREATER:       "OP_GREATER",
-		OP_LESS:          "OP_LESS",
-		OP_ADD:           "OP_ADD",
-		OP_SUBTRACT:      "OP_SUBTRACT",
-		OP_MULTIPLY:      "OP_MULTIPLY",
-		OP_DIVIDE:        "OP_DIVIDE",
-		OP_NOT:           "OP_NOT",
-		OP_NEGATE:        "OP_NEGATE",
-		OP_PRINT:         "OP_PRINT",
-		OP_JUMP:          "OP_JUMP",
-		OP_JUMP_IF_FALSE: "OP_JUMP_IF_FALSE",
-		OP_JUMP_IF_TRUE:  "OP_JUMP_IF_TRUE",
-		OP_LOOP:          "OP_LOOP",
-		OP_CALL:          "OP_CALL",
-		OP_RETURN:        "OP_RETURN",
+		OP_CONSTANT:           "OP_CONSTANT",
+		OP_CONSTANT_LONG:      "OP_CONSTANT_LONG",
+		OP_NIL:                "OP_NIL",
+		OP_TRUE:               "OP_TRUE",
+		OP_FALSE:              "OP_FALSE",
+		OP_POP:                "OP_POP",
+		OP_DEFINE_GLOBAL:      "OP_DEFINE_GLOBAL",
+		OP_GET_GLOBAL:         "OP_GET_GLOBAL",
+		OP_SET_GLOBAL:         "OP_SET_GLOBAL",
+		OP_DEFINE_GLOBAL_LONG: "OP_DEFINE_GLOBAL_LONG",
+		OP_GET_GLOBAL_LONG:    "OP_GET_GLOBAL_LONG",
+		OP_SET_GLOBAL_LONG:    "OP_SET_GLOBAL_LONG",
+		OP_GET_LOCAL:          "OP_GET_LOCAL",
+		OP_SET_LOCAL:          "OP_SET_LOCAL",
+		OP_GET_UPVALUE:        "OP_GET_UPVALUE",
+		OP_SET_UPVALUE:        "OP_SET_UPVALUE",
+		OP_GET_PROPERTY:       "OP_GET_PROPERTY",
+		OP_SET_PROPERTY:       "OP_SET_PROPERTY",
+		OP_GET_SUPER:          "OP_GET_SUPER",
+		OP_GET_PROPERTY_LONG:  "OP_GET_PROPERTY_LONG",
+		OP_SET_PROPERTY_LONG:  "OP_SET_PROPERTY_LONG",
+		OP_GET_SUPER_LONG:     "OP_GET_SUPER_LONG",
+		OP_EQUAL:              "OP_EQUAL",
+		OP_GREATER:            "OP_GREATER",
+		OP_LESS:               "OP_LESS",
+		OP_ADD:                "OP_ADD",
+		OP_SUBTRACT:           "OP_SUBTRACT",
+		OP_MULTIPLY:           "OP_MULTIPLY",
+		OP_DIVIDE:             "OP_DIVIDE",
+		OP_NOT:                "OP_NOT",
+		OP_NEGATE:             "OP_NEGATE",
+		OP_PRINT:              "OP_PRINT",
+		OP_JUMP:               "OP_JUMP",
+		OP_JUMP_IF_FALSE:      "OP_JUMP_IF_FALSE",
+		OP_JUMP_IF_TRUE:       "OP_JUMP_IF_TRUE",
+		OP_LOOP:               "OP_LOOP",
+		OP_CALL:               "OP_CALL",
+		OP_INVOKE:             "OP_INVOKE",
+		OP_SUPER_INVOKE:       "OP_SUPER_INVOKE",
+		OP_INVOKE_LONG:        "OP_INVOKE_LONG",
+		OP_SUPER_INVOKE_LONG:  "OP_SUPER_INVOKE_LONG",
+		OP_CLOSURE:            "OP_CLOSURE",
+		OP_CLOSURE_LONG:       "OP_CLOSURE_LONG",
+		OP_CLOSE_UPVALUE:      "OP_CLOSE_UPVALUE",
+		OP_RETURN:             "OP_RETURN",
+		OP_CLASS:              "OP_CLASS",
+		OP_INHERIT:            "OP_INHERIT",
+		OP_METHOD:             "OP_METHOD",
+		OP_CLASS_LONG:         "OP_CLASS_LONG",
+		OP_METHOD_LONG:        "OP_METHOD_LONG",
+		OP_BUILD_LIST:         "OP_BUILD_LIST",
+		OP_BUILD_MAP:          "OP_BUILD_MAP",
+		OP_INDEX_GET:          "OP_INDEX_GET",
+		OP_INDEX_SET:          "OP_INDEX_SET",
+		OP_ITER:               "OP_ITER",
+		OP_ITER_NEXT:          "OP_ITER_NEXT",
 	}
 }
 
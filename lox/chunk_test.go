@@ -0,0 +1,60 @@
+package lox
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAddConstantDeduplicates(t *testing.T) {
+	chunk := NewChunk()
+
+	one := chunk.AddConstant(ValueNumber(1))
+	hello := chunk.AddConstant(ValueString("hello"))
+
+	if got := chunk.AddConstant(ValueNumber(1)); got != one {
+		t.Errorf("expected 1 to reuse index %d, got %d", one, got)
+	}
+
+	if got := chunk.AddConstant(ValueString("hello")); got != hello {
+		t.Errorf("expected \"hello\" to reuse index %d, got %d", hello, got)
+	}
+
+	if got := chunk.AddConstant(ValueString("1")); got == one {
+		t.Errorf("expected the string \"1\" not to share the number 1's index")
+	}
+
+	if n := len(*chunk.constants); n != 3 {
+		t.Errorf("expected 3 constants, got %d", n)
+	}
+}
+
+func TestAddConstantKeepsDistinctBits(t *testing.T) {
+	chunk := NewChunk()
+
+	zero := chunk.AddConstant(ValueNumber(0))
+	negZero := chunk.AddConstant(ValueNumber(math.Copysign(0, -1)))
+	if zero == negZero {
+		t.Errorf("expected 0 and -0 to get their own constants")
+	}
+
+	// NaN is never equal to itself, but the same NaN bits can share a slot
+	nan := chunk.AddConstant(ValueNumber(math.NaN()))
+	if nan == zero || nan == negZero {
+		t.Errorf("expected NaN to get its own constant")
+	}
+
+	if got := chunk.AddConstant(ValueNumber(math.NaN())); got != nan {
+		t.Errorf("expected NaN to reuse index %d, got %d", nan, got)
+	}
+
+	if v := chunk.constantAt(negZero).(ValueNumber); !math.Signbit(float64(v)) {
+		t.Errorf("expected -0 to keep its sign, got %v", v)
+	}
+
+	// functions are never deduplicated
+	function := NewFunction()
+	first := chunk.AddConstant(*function)
+	if second := chunk.AddConstant(*function); first == second {
+		t.Errorf("expected each function to get its own constant")
+	}
+}
@@ -3,6 +3,7 @@ package lox
 import (
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"strconv"
@@ -10,31 +11,63 @@ import (
 
 // types
 const UINT8_COUNT = math.MaxUint8 + 1
+const MAX_LONG_CONSTANT = 1<<24 - 1
 
 type Compiler struct {
-	enclosing  *Compiler
-	function   *ValueFunction
-	kind       FunctionType
-	rules      map[TokenType]ParseRule
-	localCount int
-	scopeDepth int
-	locals     [UINT8_COUNT]Local
+	parser       *Parser
+	enclosing    *Compiler
+	currentClass *ClassCompiler
+	currentLoop  *LoopCompiler
+	function     *ValueFunction
+	kind         FunctionType
+	rules        map[TokenType]ParseRule
+	localCount   int
+	scopeDepth   int
+	locals       [UINT8_COUNT]Local
+	upvalues     [UINT8_COUNT]Upvalue
+}
+
+// ClassCompiler tracks the class we're in the middle of compiling, so that
+// we know whether it's ok to use 'this'
+type ClassCompiler struct {
+	enclosing     *ClassCompiler
+	hasSuperclass bool
+}
+
+// LoopCompiler tracks the innermost loop or switch we're compiling, so that
+// break and continue know where to jump and which locals to discard on the
+// way. A switch only catches break; continue goes to the loop around it.
+type LoopCompiler struct {
+	enclosing  *LoopCompiler
+	isSwitch   bool
+	start      int   // where continue jumps to
+	scopeDepth int   // locals deeper than this belong to the loop body
+	breakJumps []int // to be patched to the end of the loop
 }
 
 type Local struct {
-	name  Token
-	depth int
+	name       Token
+	depth      int
+	isCaptured bool
 }
 
-// this is a global, basically, set up when we call Compile()
-var parser Parser
+type Upvalue struct {
+	index   byte
+	isLocal bool
+}
 
+// Parser holds the state for a single call to Compile; it's shared by the
+// compilers for every function in the source.
 type Parser struct {
+	errOut    io.Writer
 	scanner   *Scanner
 	current   Token
 	previous  Token
 	hadError  bool
 	panicMode bool
+	codeOut   io.Writer // where to disassemble each function, if anywhere
+
+	diagnostics []Diagnostic
 }
 
 // This is nullary because it gets bound to the compiler instance on create,
@@ -65,37 +98,64 @@ const (
 
 const (
 	TYPE_FUNCTION FunctionType = iota
+	TYPE_INITIALIZER
+	TYPE_METHOD
 	TYPE_SCRIPT
 )
 
-func NewCompiler(kind FunctionType, parent *Compiler) *Compiler {
+func NewCompiler(parser *Parser, kind FunctionType, parent *Compiler) *Compiler {
 	c := &Compiler{
+		parser:    parser,
 		enclosing: parent,
 		function:  NewFunction(),
 		kind:      kind,
 	}
 
+	if parent != nil {
+		c.currentClass = parent.currentClass
+	}
+
 	c.initRules()
 
 	if kind != TYPE_SCRIPT {
 		c.function.name = parser.previous.lexeme
 	}
 
-	local := c.locals[c.localCount]
-	local.name.lexeme = ""
+	// slot zero holds the function itself, or the receiver for methods
+	local := &c.locals[c.localCount]
 	c.localCount++
 
+	if kind == TYPE_METHOD || kind == TYPE_INITIALIZER {
+		local.name.lexeme = "this"
+	} else {
+		local.name.lexeme = ""
+	}
+
 	return c
 }
 
 func Compile(source string) (ValueFunction, error) {
-	parser = Parser{
+	return CompileWithDiagnostics(source, os.Stderr)
+}
+
+// CompileWithDiagnostics is like Compile, but writes any error messages to
+// errOut rather than to stderr.
+func CompileWithDiagnostics(source string, errOut io.Writer) (ValueFunction, error) {
+	return compile(source, errOut, nil)
+}
+
+// compile does the work for the Compile functions. If codeOut isn't nil, the
+// disassembly of each function gets written there as it's finished.
+func compile(source string, errOut io.Writer, codeOut io.Writer) (ValueFunction, error) {
+	parser := &Parser{
+		errOut:    errOut,
 		scanner:   NewScanner(source),
 		hadError:  false,
 		panicMode: false,
+		codeOut:   codeOut,
 	}
 
-	c := NewCompiler(TYPE_SCRIPT, nil)
+	c := NewCompiler(parser, TYPE_SCRIPT, nil)
 
 	parser.advance()
 
@@ -106,7 +166,7 @@ func Compile(source string) (ValueFunction, error) {
 	function := c.end()
 
 	if parser.hadError {
-		return ValueFunction{}, errors.New("compilation error")
+		return ValueFunction{}, &CompileError{Diagnostics: parser.diagnostics}
 	}
 
 	return function, nil
@@ -116,10 +176,13 @@ func (c *Compiler) initRules() {
 	c.rules = map[TokenType]ParseRule{
 		TOKEN_LEFT_PAREN:    {c.grouping, c.call, PREC_CALL},
 		TOKEN_RIGHT_PAREN:   {nil, nil, PREC_NONE},
-		TOKEN_LEFT_BRACE:    {nil, nil, PREC_NONE},
+		TOKEN_LEFT_BRACE:    {c.mapLiteral, nil, PREC_NONE},
 		TOKEN_RIGHT_BRACE:   {nil, nil, PREC_NONE},
+		TOKEN_LEFT_BRACKET:  {c.list, c.index, PREC_CALL},
+		TOKEN_RIGHT_BRACKET: {nil, nil, PREC_NONE},
 		TOKEN_COMMA:         {nil, nil, PREC_NONE},
-		TOKEN_DOT:           {nil, nil, PREC_NONE},
+		TOKEN_COLON:         {nil, nil, PREC_NONE},
+		TOKEN_DOT:           {nil, c.dot, PREC_CALL},
 		TOKEN_MINUS:         {c.unary, c.binary, PREC_TERM},
 		TOKEN_PLUS:          {nil, c.binary, PREC_TERM},
 		TOKEN_SEMICOLON:     {nil, nil, PREC_NONE},
@@ -137,18 +200,24 @@ func (c *Compiler) initRules() {
 		TOKEN_STRING:        {c.string, nil, PREC_NONE},
 		TOKEN_NUMBER:        {c.number, nil, PREC_NONE},
 		TOKEN_AND:           {nil, c.and, PREC_AND},
+		TOKEN_BREAK:         {nil, nil, PREC_NONE},
+		TOKEN_CASE:          {nil, nil, PREC_NONE},
 		TOKEN_CLASS:         {nil, nil, PREC_NONE},
+		TOKEN_CONTINUE:      {nil, nil, PREC_NONE},
+		TOKEN_DEFAULT:       {nil, nil, PREC_NONE},
 		TOKEN_ELSE:          {nil, nil, PREC_NONE},
 		TOKEN_FALSE:         {c.literal, nil, PREC_NONE},
 		TOKEN_FOR:           {nil, nil, PREC_NONE},
 		TOKEN_FUN:           {nil, nil, PREC_NONE},
 		TOKEN_IF:            {nil, nil, PREC_NONE},
+		TOKEN_IN:            {nil, nil, PREC_NONE},
 		TOKEN_NIL:           {c.literal, nil, PREC_NONE},
 		TOKEN_OR:            {nil, c.or, PREC_OR},
 		TOKEN_PRINT:         {nil, nil, PREC_NONE},
 		TOKEN_RETURN:        {nil, nil, PREC_NONE},
-		TOKEN_SUPER:         {nil, nil, PREC_NONE},
-		TOKEN_THIS:          {nil, nil, PREC_NONE},
+		TOKEN_SUPER:         {c.super, nil, PREC_NONE},
+		TOKEN_SWITCH:        {nil, nil, PREC_NONE},
+		TOKEN_THIS:          {c.this, nil, PREC_NONE},
 		TOKEN_TRUE:          {c.literal, nil, PREC_NONE},
 		TOKEN_VAR:           {nil, nil, PREC_NONE},
 		TOKEN_WHILE:         {nil, nil, PREC_NONE},
@@ -158,19 +227,83 @@ func (c *Compiler) initRules() {
 }
 
 func (c *Compiler) declaration() {
-	if parser.match(TOKEN_FUN) {
+	if c.parser.match(TOKEN_CLASS) {
+		c.classDeclaration()
+	} else if c.parser.match(TOKEN_FUN) {
 		c.funDeclaration()
-	} else if parser.match(TOKEN_VAR) {
+	} else if c.parser.match(TOKEN_VAR) {
 		c.varDeclaration()
 	} else {
 		c.statement()
 	}
 
-	if parser.panicMode {
-		parser.synchronize()
+	if c.parser.panicMode {
+		c.parser.synchronize()
 	}
 }
 
+func (c *Compiler) classDeclaration() {
+	c.parser.consume(TOKEN_IDENTIFIER, "Expect class name.")
+	className := c.parser.previous
+	nameConstant := c.identifierConstant(c.parser.previous)
+	c.declareVariable()
+
+	c.emitConstantOp(OP_CLASS, OP_CLASS_LONG, nameConstant)
+	c.defineVariable(nameConstant)
+
+	c.currentClass = &ClassCompiler{enclosing: c.currentClass}
+
+	if c.parser.match(TOKEN_LESS) {
+		c.parser.consume(TOKEN_IDENTIFIER, "Expect superclass name.")
+		c.variable(false)
+
+		if identifiersEqual(className, c.parser.previous) {
+			c.parser.error("A class can't inherit from itself.")
+		}
+
+		// the superclass lives in a local named 'super', in its own scope so
+		// that each class gets its own
+		c.beginScope()
+		c.addLocal(syntheticToken("super"))
+		c.defineVariable(0)
+
+		c.namedVariable(className, false)
+		c.emitOp(OP_INHERIT)
+		c.currentClass.hasSuperclass = true
+	}
+
+	// load the class back onto the stack so OP_METHOD can find it
+	c.namedVariable(className, false)
+
+	c.parser.consume(TOKEN_LEFT_BRACE, "Expect '{' before class body.")
+
+	for !c.parser.check(TOKEN_RIGHT_BRACE) && !c.parser.check(TOKEN_EOF) {
+		c.method()
+	}
+
+	c.parser.consume(TOKEN_RIGHT_BRACE, "Expect '}' after class body.")
+	c.emitOp(OP_POP)
+
+	if c.currentClass.hasSuperclass {
+		c.endScope()
+	}
+
+	c.currentClass = c.currentClass.enclosing
+}
+
+func (c *Compiler) method() {
+	c.parser.consume(TOKEN_IDENTIFIER, "Expect method name.")
+	constant := c.identifierConstant(c.parser.previous)
+
+	kind := TYPE_METHOD
+	if c.parser.previous.lexeme == "init" {
+		kind = TYPE_INITIALIZER
+	}
+
+	c.compileFunction(kind)
+	c.emitConstantOp(OP_METHOD, OP_METHOD_LONG, constant)
+}
+
 func (c *Compiler) funDeclaration() {
 	global := c.parseVariable("Expect function name.")
 	c.markInitialized()
@@ -180,30 +313,41 @@ func (c *Compiler) funDeclaration() {
 
 func (c *Compiler) varDeclaration() {
 	global := c.parseVariable("Expect variable name.")
+	c.varInitializer(global)
+}
 
-	if parser.match(TOKEN_EQUAL) {
+// varInitializer compiles the rest of a var declaration, once we've got the
+// name.
+func (c *Compiler) varInitializer(global int) {
+	if c.parser.match(TOKEN_EQUAL) {
 		c.expression()
 	} else {
 		c.emitOp(OP_NIL)
 	}
 
-	parser.consume(TOKEN_SEMICOLON, "Expect ';' after variable declaration")
+	c.parser.consume(TOKEN_SEMICOLON, "Expect ';' after variable declaration")
 
 	c.defineVariable(global)
 }
 
 func (c *Compiler) statement() {
-	if parser.match(TOKEN_PRINT) {
+	if c.parser.match(TOKEN_PRINT) {
 		c.printStatement()
-	} else if parser.match(TOKEN_FOR) {
+	} else if c.parser.match(TOKEN_FOR) {
 		c.forStatement()
-	} else if parser.match(TOKEN_IF) {
+	} else if c.parser.match(TOKEN_IF) {
 		c.ifStatement()
-	} else if parser.match(TOKEN_RETURN) {
+	} else if c.parser.match(TOKEN_RETURN) {
 		c.returnStatement()
-	} else if parser.match(TOKEN_WHILE) {
+	} else if c.parser.match(TOKEN_WHILE) {
 		c.whileStatement()
-	} else if parser.match(TOKEN_LEFT_BRACE) {
+	} else if c.parser.match(TOKEN_SWITCH) {
+		c.switchStatement()
+	} else if c.parser.match(TOKEN_BREAK) {
+		c.breakStatement()
+	} else if c.parser.match(TOKEN_CONTINUE) {
+		c.continueStatement()
+	} else if c.parser.match(TOKEN_LEFT_BRACE) {
 		c.beginScope()
 		c.block()
 		c.endScope()
@@ -214,38 +358,53 @@ func (c *Compiler) statement() {
 
 func (c *Compiler) printStatement() {
 	c.expression()
-	parser.consume(TOKEN_SEMICOLON, "Expect ';' after value")
+	c.parser.consume(TOKEN_SEMICOLON, "Expect ';' after value")
 	c.emitOp(OP_PRINT)
 }
 
 func (c *Compiler) returnStatement() {
 	if c.kind == TYPE_SCRIPT {
-		parser.error("Can't return from top-level code.")
+		c.parser.error("Can't return from top-level code.")
 	}
 
-	if parser.match(TOKEN_SEMICOLON) {
+	if c.parser.match(TOKEN_SEMICOLON) {
 		c.emitReturn()
 	} else {
+		if c.kind == TYPE_INITIALIZER {
+			c.parser.error("Can't return a value from an initializer.")
+		}
+
 		c.expression()
-		parser.consume(TOKEN_SEMICOLON, "Expect ';' after return value")
+		c.parser.consume(TOKEN_SEMICOLON, "Expect ';' after return value")
 		c.emitOp(OP_RETURN)
 	}
 }
 
 func (c *Compiler) expressionStatement() {
 	c.expression()
-	parser.consume(TOKEN_SEMICOLON, "Expect ';' after expression")
+	c.parser.consume(TOKEN_SEMICOLON, "Expect ';' after expression")
 	c.emitOp(OP_POP)
 }
 
 func (c *Compiler) forStatement() {
 	c.beginScope()
-	parser.consume(TOKEN_LEFT_PAREN, "Expect '(' after 'for'.")
+	c.parser.consume(TOKEN_LEFT_PAREN, "Expect '(' after 'for'.")
 
-	if parser.match(TOKEN_SEMICOLON) {
+	if c.parser.match(TOKEN_SEMICOLON) {
 		// no initializer
-	} else if parser.match(TOKEN_VAR) {
-		c.varDeclaration()
+	} else if c.parser.match(TOKEN_VAR) {
+		c.parser.consume(TOKEN_IDENTIFIER, "Expect variable name.")
+		name := c.parser.previous
+
+		if c.parser.match(TOKEN_IN) {
+			c.forInStatement(name)
+			c.endScope()
+			return
+		}
+
+		// we're in the for's scope, so this is always a local
+		c.declareVariable()
+		c.varInitializer(0)
 	} else {
 		c.expression()
 	}
@@ -253,27 +412,28 @@ func (c *Compiler) forStatement() {
 	loopStart := c.currentChunk().Count()
 	exitJump := -1
 
-	if !parser.match(TOKEN_SEMICOLON) {
+	if !c.parser.match(TOKEN_SEMICOLON) {
 		c.expression()
-		parser.consume(TOKEN_SEMICOLON, "Expect ';' after loop condition.")
+		c.parser.consume(TOKEN_SEMICOLON, "Expect ';' after loop condition.")
 
 		exitJump = c.emitJump(OP_JUMP_IF_FALSE)
 		c.emitOp(OP_POP)
 	}
 
-	if !parser.match(TOKEN_RIGHT_PAREN) {
+	if !c.parser.match(TOKEN_RIGHT_PAREN) {
 		bodyJump := c.emitJump(OP_JUMP)
 		incStart := c.currentChunk().Count()
 
 		c.expression()
 		c.emitOp(OP_POP)
-		parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after for clauses.")
+		c.parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after for clauses.")
 
 		c.emitLoop(loopStart)
 		loopStart = incStart
 		c.patchJump(bodyJump)
 	}
 
+	c.beginLoop(loopStart)
 	c.statement() // loop body
 
 	c.emitLoop(loopStart)
@@ -282,13 +442,44 @@ func (c *Compiler) forStatement() {
 		c.emitOp(OP_POP)
 	}
 
+	c.endLoop()
+	c.endScope()
+}
+
+// forInStatement compiles the rest of 'for (var name in iterable) body'. The
+// iterator lives in a hidden local, and each time round the loop
+// OP_ITER_NEXT pushes the next value as a fresh local for the body (so
+// closures capture each one separately), or jumps out when it's done.
+func (c *Compiler) forInStatement(name Token) {
+	c.expression()
+	c.parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after for-in clause.")
+
+	c.emitOp(OP_ITER)
+	c.addLocal(syntheticToken(" iter"))
+	c.markInitialized()
+
+	loopStart := c.currentChunk().Count()
+	exitJump := c.emitJump(OP_ITER_NEXT)
+
+	c.beginLoop(loopStart)
+	c.beginScope()
+	c.addLocal(name)
+	c.markInitialized()
+
+	c.statement() // loop body
+
 	c.endScope()
+	c.emitLoop(loopStart)
+
+	c.patchJump(exitJump)
+	c.emitOp(OP_POP) // OP_ITER_NEXT pushes nil when it's done
+	c.endLoop()
 }
 
 func (c *Compiler) ifStatement() {
-	parser.consume(TOKEN_LEFT_PAREN, "Expect '(' after if.")
+	c.parser.consume(TOKEN_LEFT_PAREN, "Expect '(' after if.")
 	c.expression()
-	parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after condition.")
+	c.parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after condition.")
 
 	thenJump := c.emitJump(OP_JUMP_IF_FALSE)
 	c.emitOp(OP_POP) // pop off the condition
@@ -300,7 +491,7 @@ func (c *Compiler) ifStatement() {
 	c.patchJump(thenJump)
 	c.emitOp(OP_POP) // the condition, else case
 
-	if parser.match(TOKEN_ELSE) {
+	if c.parser.match(TOKEN_ELSE) {
 		c.statement()
 	}
 
@@ -309,18 +500,180 @@ func (c *Compiler) ifStatement() {
 
 func (c *Compiler) whileStatement() {
 	loopStart := c.currentChunk().Count()
-	parser.consume(TOKEN_LEFT_PAREN, "Expect '(' after while.")
+	c.parser.consume(TOKEN_LEFT_PAREN, "Expect '(' after while.")
 	c.expression()
-	parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after condition.")
+	c.parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after condition.")
 
 	exitJump := c.emitJump(OP_JUMP_IF_FALSE)
 	c.emitOp(OP_POP)
+
+	c.beginLoop(loopStart)
 	c.statement()
 
 	c.emitLoop(loopStart)
 
 	c.patchJump(exitJump)
 	c.emitOp(OP_POP)
+	c.endLoop()
+}
+
+// switchStatement compiles a switch into a chain of tests, one per case
+// value, comparing against the subject, which lives in a hidden local for
+// the duration. There's no fallthrough: each case body jumps to the end. The
+// default can come anywhere, so we jump over its body on the way down, and
+// jump back to it if we get to the end without a match. break leaves the
+// switch, as in C, though with no fallthrough it's only needed to leave a
+// case early; continue still applies to the enclosing loop.
+func (c *Compiler) switchStatement() {
+	c.beginScope()
+
+	c.parser.consume(TOKEN_LEFT_PAREN, "Expect '(' after 'switch'.")
+	c.expression()
+	c.parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after value.")
+
+	// the space means this can't clash with a real variable
+	c.addLocal(syntheticToken(" switch"))
+	c.markInitialized()
+	subject := byte(c.localCount - 1)
+
+	c.parser.consume(TOKEN_LEFT_BRACE, "Expect '{' before switch cases.")
+	c.beginSwitch()
+
+	var endJumps []int
+	defaultStart := -1
+
+	for !c.parser.check(TOKEN_RIGHT_BRACE) && !c.parser.check(TOKEN_EOF) {
+		if c.parser.match(TOKEN_CASE) {
+			var matchJumps []int
+
+			for {
+				c.emitOpAndArg(OP_GET_LOCAL, subject)
+				c.expression()
+				c.emitOp(OP_EQUAL)
+				matchJumps = append(matchJumps, c.emitJump(OP_JUMP_IF_TRUE))
+				c.emitOp(OP_POP)
+
+				if !c.parser.match(TOKEN_COMMA) {
+					break
+				}
+			}
+
+			c.parser.consume(TOKEN_COLON, "Expect ':' after case value.")
+			nextCase := c.emitJump(OP_JUMP)
+
+			for _, jump := range matchJumps {
+				c.patchJump(jump)
+			}
+			c.emitOp(OP_POP) // the result of the comparison
+
+			c.caseBody()
+			endJumps = append(endJumps, c.emitJump(OP_JUMP))
+			c.patchJump(nextCase)
+		} else if c.parser.match(TOKEN_DEFAULT) {
+			if defaultStart != -1 {
+				c.parser.error("Can't have more than one 'default' in a switch.")
+			}
+
+			c.parser.consume(TOKEN_COLON, "Expect ':' after 'default'.")
+			skipDefault := c.emitJump(OP_JUMP)
+
+			defaultStart = c.currentChunk().Count()
+			c.caseBody()
+			endJumps = append(endJumps, c.emitJump(OP_JUMP))
+			c.patchJump(skipDefault)
+		} else {
+			c.parser.errorAtCurrent("Expect 'case' or 'default'.")
+			c.parser.advance()
+		}
+	}
+
+	c.parser.consume(TOKEN_RIGHT_BRACE, "Expect '}' after switch cases.")
+
+	// nothing matched
+	if defaultStart != -1 {
+		c.emitLoop(defaultStart)
+	}
+
+	for _, jump := range endJumps {
+		c.patchJump(jump)
+	}
+
+	c.endLoop()
+	c.endScope()
+}
+
+// caseBody compiles the statements up to the next case, in their own scope.
+func (c *Compiler) caseBody() {
+	c.beginScope()
+
+	for !c.parser.check(TOKEN_CASE) && !c.parser.check(TOKEN_DEFAULT) &&
+		!c.parser.check(TOKEN_RIGHT_BRACE) && !c.parser.check(TOKEN_EOF) {
+		c.declaration()
+	}
+
+	c.endScope()
+}
+
+func (c *Compiler) breakStatement() {
+	if c.currentLoop == nil {
+		c.parser.error("Can't use 'break' outside of a loop or switch.")
+	}
+
+	c.parser.consume(TOKEN_SEMICOLON, "Expect ';' after 'break'.")
+
+	if c.currentLoop != nil {
+		c.discardLocals(c.currentLoop.scopeDepth)
+		jump := c.emitJump(OP_JUMP)
+		c.currentLoop.breakJumps = append(c.currentLoop.breakJumps, jump)
+	}
+}
+
+func (c *Compiler) continueStatement() {
+	loop := c.currentLoop
+	for loop != nil && loop.isSwitch {
+		loop = loop.enclosing
+	}
+
+	if loop == nil {
+		c.parser.error("Can't use 'continue' outside of a loop.")
+	}
+
+	c.parser.consume(TOKEN_SEMICOLON, "Expect ';' after 'continue'.")
+
+	if loop != nil {
+		c.discardLocals(loop.scopeDepth)
+		c.emitLoop(loop.start)
+	}
+}
+
+// beginLoop is called just before compiling a loop body; start is where
+// continue should jump to.
+func (c *Compiler) beginLoop(start int) {
+	c.currentLoop = &LoopCompiler{
+		enclosing:  c.currentLoop,
+		start:      start,
+		scopeDepth: c.scopeDepth,
+	}
+}
+
+// beginSwitch is called just before compiling the cases of a switch, so that
+// break leaves the switch rather than the loop around it.
+func (c *Compiler) beginSwitch() {
+	c.currentLoop = &LoopCompiler{
+		enclosing:  c.currentLoop,
+		isSwitch:   true,
+		scopeDepth: c.scopeDepth,
+	}
+}
+
+// endLoop is called once we're past the end of the loop (or switch), which
+// is where any breaks land.
+func (c *Compiler) endLoop() {
+	for _, jump := range c.currentLoop.breakJumps {
+		c.patchJump(jump)
+	}
+
+	c.currentLoop = c.currentLoop.enclosing
 }
 
 func (c *Compiler) expression() {
@@ -328,45 +681,56 @@ func (c *Compiler) expression() {
 }
 
 func (c *Compiler) block() {
-	for !parser.check(TOKEN_RIGHT_BRACE) && !parser.check(TOKEN_EOF) {
+	for !c.parser.check(TOKEN_RIGHT_BRACE) && !c.parser.check(TOKEN_EOF) {
 		c.declaration()
 	}
 
-	parser.consume(TOKEN_RIGHT_BRACE, "Expect '}' after block.")
+	c.parser.consume(TOKEN_RIGHT_BRACE, "Expect '}' after block.")
 }
 
 func (c *Compiler) compileFunction(kind FunctionType) {
-	local := NewCompiler(kind, c)
+	local := NewCompiler(c.parser, kind, c)
 	local.beginScope()
 
-	parser.consume(TOKEN_LEFT_PAREN, "Expect '(' after function name.")
+	c.parser.consume(TOKEN_LEFT_PAREN, "Expect '(' after function name.")
 
-	if !parser.check(TOKEN_RIGHT_PAREN) {
+	if !c.parser.check(TOKEN_RIGHT_PAREN) {
 		for {
 			local.function.arity++
 			if local.function.arity > 255 {
-				parser.errorAtCurrent("Can't have more than 255 parameters, you animal.")
+				c.parser.errorAtCurrent("Can't have more than 255 parameters, you animal.")
 			}
 
 			constant := local.parseVariable("Expect parameter name.")
 			local.defineVariable(constant)
 
-			if !parser.match(TOKEN_COMMA) {
+			if !c.parser.match(TOKEN_COMMA) {
 				break
 			}
 		}
 	}
 
-	parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after parameters.")
-	parser.consume(TOKEN_LEFT_BRACE, "Expect '{' before function body.")
+	c.parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after parameters.")
+	c.parser.consume(TOKEN_LEFT_BRACE, "Expect '{' before function body.")
 	local.block()
 
 	function := local.end()
-	c.emitOpAndArg(OP_CONSTANT, c.makeConstant(function))
+	c.emitConstantOp(OP_CLOSURE, OP_CLOSURE_LONG, c.makeConstant(function))
+
+	for i := 0; i < function.upvalueCount; i++ {
+		upvalue := local.upvalues[i]
+
+		isLocal := byte(0)
+		if upvalue.isLocal {
+			isLocal = 1
+		}
+
+		c.emitBytes(isLocal, upvalue.index)
+	}
 }
 
 func (c *Compiler) number(_ bool) {
-	n, err := strconv.ParseFloat(parser.previous.lexeme, 64)
+	n, err := strconv.ParseFloat(c.parser.previous.lexeme, 64)
 	if err != nil {
 		panic("strconv.ParseFloat failed somehow")
 	}
@@ -375,32 +739,40 @@ func (c *Compiler) number(_ bool) {
 }
 
 func (c *Compiler) string(_ bool) {
-	s := parser.previous.lexeme
+	s := c.parser.previous.lexeme
 	c.emitConstant(ValueString(s[1 : len(s)-1]))
 }
 
 func (c *Compiler) variable(canAssign bool) {
-	c.namedVariable(parser.previous, canAssign)
+	c.namedVariable(c.parser.previous, canAssign)
 }
 
 func (c *Compiler) namedVariable(name Token, canAssign bool) {
 	var getOp, setOp OpCode
-	arg, err := c.resolveLocal(name)
 
-	if err == nil {
+	// only globals have long forms; locals and upvalues always fit in a byte
+	var getLongOp, setLongOp OpCode
+	var arg int
+
+	if local, err := c.resolveLocal(name); err == nil {
+		arg = int(local)
 		getOp = OP_GET_LOCAL
 		setOp = OP_SET_LOCAL
+	} else if upvalue, err := c.resolveUpvalue(name); err == nil {
+		arg = int(upvalue)
+		getOp = OP_GET_UPVALUE
+		setOp = OP_SET_UPVALUE
 	} else {
 		arg = c.identifierConstant(name)
-		getOp = OP_GET_GLOBAL
-		setOp = OP_SET_GLOBAL
+		getOp, getLongOp = OP_GET_GLOBAL, OP_GET_GLOBAL_LONG
+		setOp, setLongOp = OP_SET_GLOBAL, OP_SET_GLOBAL_LONG
 	}
 
-	if canAssign && parser.match(TOKEN_EQUAL) {
+	if canAssign && c.parser.match(TOKEN_EQUAL) {
 		c.expression()
-		c.emitOpAndArg(setOp, arg)
+		c.emitConstantOp(setOp, setLongOp, arg)
 	} else {
-		c.emitOpAndArg(getOp, arg)
+		c.emitConstantOp(getOp, getLongOp, arg)
 	}
 }
 
@@ -409,7 +781,7 @@ func (c *Compiler) resolveLocal(name Token) (byte, error) {
 		local := c.locals[i]
 		if identifiersEqual(name, local.name) {
 			if local.depth == -1 {
-				parser.error("Can't read local variable in its own initializer")
+				c.parser.error("Can't read local variable in its own initializer")
 			}
 
 			return byte(i), nil
@@ -419,13 +791,52 @@ func (c *Compiler) resolveLocal(name Token) (byte, error) {
 	return 0, errors.New("local var not found")
 }
 
+// resolveUpvalue looks for a local variable in the enclosing functions,
+// threading an upvalue through each compiler on the way back down.
+func (c *Compiler) resolveUpvalue(name Token) (byte, error) {
+	if c.enclosing == nil {
+		return 0, errors.New("upvalue not found")
+	}
+
+	if local, err := c.enclosing.resolveLocal(name); err == nil {
+		c.enclosing.locals[local].isCaptured = true
+		return c.addUpvalue(local, true), nil
+	}
+
+	if upvalue, err := c.enclosing.resolveUpvalue(name); err == nil {
+		return c.addUpvalue(upvalue, false), nil
+	}
+
+	return 0, errors.New("upvalue not found")
+}
+
+func (c *Compiler) addUpvalue(index byte, isLocal bool) byte {
+	upvalueCount := c.function.upvalueCount
+
+	for i := 0; i < upvalueCount; i++ {
+		upvalue := c.upvalues[i]
+		if upvalue.index == index && upvalue.isLocal == isLocal {
+			return byte(i)
+		}
+	}
+
+	if upvalueCount == UINT8_COUNT {
+		c.parser.error("Too many closure variables in function.")
+		return 0
+	}
+
+	c.upvalues[upvalueCount] = Upvalue{index, isLocal}
+	c.function.upvalueCount++
+	return byte(upvalueCount)
+}
+
 func (c *Compiler) grouping(_ bool) {
 	c.expression()
-	parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after expression.")
+	c.parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after expression.")
 }
 
 func (c *Compiler) unary(_ bool) {
-	op := parser.previous.kind
+	op := c.parser.previous.kind
 	c.parsePrecedence(PREC_UNARY)
 
 	switch op {
@@ -439,7 +850,7 @@ func (c *Compiler) unary(_ bool) {
 }
 
 func (c *Compiler) binary(_ bool) {
-	op := parser.previous.kind
+	op := c.parser.previous.kind
 	rule := c.getRule(op)
 	c.parsePrecedence(rule.precedence + 1)
 
@@ -477,8 +888,114 @@ func (c *Compiler) call(bool) {
 	c.emitOpAndArg(OP_CALL, argCount)
 }
 
+func (c *Compiler) dot(canAssign bool) {
+	c.parser.consume(TOKEN_IDENTIFIER, "Expect property name after '.'.")
+	name := c.identifierConstant(c.parser.previous)
+
+	if canAssign && c.parser.match(TOKEN_EQUAL) {
+		c.expression()
+		c.emitConstantOp(OP_SET_PROPERTY, OP_SET_PROPERTY_LONG, name)
+	} else if c.parser.match(TOKEN_LEFT_PAREN) {
+		// fast path: invoke the method directly without a bound method
+		argCount := c.argumentList()
+		c.emitConstantOp(OP_INVOKE, OP_INVOKE_LONG, name)
+		c.emitByte(argCount)
+	} else {
+		c.emitConstantOp(OP_GET_PROPERTY, OP_GET_PROPERTY_LONG, name)
+	}
+}
+
+func (c *Compiler) list(_ bool) {
+	count := 0
+
+	for !c.parser.check(TOKEN_RIGHT_BRACKET) {
+		c.expression()
+		count++
+
+		if count == UINT8_COUNT {
+			c.parser.error("Can't have more than 255 items in a list literal.")
+		}
+
+		if !c.parser.match(TOKEN_COMMA) {
+			break
+		}
+	}
+
+	c.parser.consume(TOKEN_RIGHT_BRACKET, "Expect ']' after list items.")
+	c.emitOpAndArg(OP_BUILD_LIST, byte(count))
+}
+
+// mapLiteral is a '{' in expression position; at the start of a statement
+// it's a block instead.
+func (c *Compiler) mapLiteral(_ bool) {
+	count := 0
+
+	for !c.parser.check(TOKEN_RIGHT_BRACE) {
+		c.expression()
+		c.parser.consume(TOKEN_COLON, "Expect ':' after map key.")
+		c.expression()
+		count++
+
+		if count == UINT8_COUNT {
+			c.parser.error("Can't have more than 255 entries in a map literal.")
+		}
+
+		if !c.parser.match(TOKEN_COMMA) {
+			break
+		}
+	}
+
+	c.parser.consume(TOKEN_RIGHT_BRACE, "Expect '}' after map entries.")
+	c.emitOpAndArg(OP_BUILD_MAP, byte(count))
+}
+
+func (c *Compiler) index(canAssign bool) {
+	c.expression()
+	c.parser.consume(TOKEN_RIGHT_BRACKET, "Expect ']' after index.")
+
+	if canAssign && c.parser.match(TOKEN_EQUAL) {
+		c.expression()
+		c.emitOp(OP_INDEX_SET)
+	} else {
+		c.emitOp(OP_INDEX_GET)
+	}
+}
+
+func (c *Compiler) this(_ bool) {
+	if c.currentClass == nil {
+		c.parser.error("Can't use 'this' outside of a class.")
+		return
+	}
+
+	c.variable(false)
+}
+
+func (c *Compiler) super(_ bool) {
+	if c.currentClass == nil {
+		c.parser.error("Can't use 'super' outside of a class.")
+	} else if !c.currentClass.hasSuperclass {
+		c.parser.error("Can't use 'super' in a class with no superclass.")
+	}
+
+	c.parser.consume(TOKEN_DOT, "Expect '.' after 'super'.")
+	c.parser.consume(TOKEN_IDENTIFIER, "Expect superclass method name.")
+	name := c.identifierConstant(c.parser.previous)
+
+	c.namedVariable(syntheticToken("this"), false)
+
+	if c.parser.match(TOKEN_LEFT_PAREN) {
+		argCount := c.argumentList()
+		c.namedVariable(syntheticToken("super"), false)
+		c.emitConstantOp(OP_SUPER_INVOKE, OP_SUPER_INVOKE_LONG, name)
+		c.emitByte(argCount)
+	} else {
+		c.namedVariable(syntheticToken("super"), false)
+		c.emitConstantOp(OP_GET_SUPER, OP_GET_SUPER_LONG, name)
+	}
+}
+
 func (c *Compiler) literal(_ bool) {
-	switch parser.previous.kind {
+	switch c.parser.previous.kind {
 	case TOKEN_FALSE:
 		c.emitOp(OP_FALSE)
 	case TOKEN_NIL:
@@ -513,32 +1030,32 @@ func (c *Compiler) getRule(op TokenType) ParseRule {
 }
 
 func (c *Compiler) parsePrecedence(precedence Precedence) {
-	parser.advance()
-	prefixRule := c.getRule(parser.previous.kind).prefix
+	c.parser.advance()
+	prefixRule := c.getRule(c.parser.previous.kind).prefix
 	if prefixRule == nil {
-		parser.error("Expect expression.")
+		c.parser.error("Expect expression.")
 		return
 	}
 
 	canAssign := precedence <= PREC_ASSIGNMENT
 	prefixRule(canAssign)
 
-	for precedence <= c.getRule(parser.current.kind).precedence {
-		parser.advance()
-		infixRule := c.getRule(parser.previous.kind).infix
+	for precedence <= c.getRule(c.parser.current.kind).precedence {
+		c.parser.advance()
+		infixRule := c.getRule(c.parser.previous.kind).infix
 		infixRule(canAssign)
 	}
 }
 
-func (c *Compiler) parseVariable(errMsg string) byte {
-	parser.consume(TOKEN_IDENTIFIER, errMsg)
+func (c *Compiler) parseVariable(errMsg string) int {
+	c.parser.consume(TOKEN_IDENTIFIER, errMsg)
 
 	c.declareVariable()
 	if c.scopeDepth > 0 {
 		return 0
 	}
 
-	return c.identifierConstant(parser.previous)
+	return c.identifierConstant(c.parser.previous)
 }
 
 func (c *Compiler) markInitialized() {
@@ -549,41 +1066,45 @@ func (c *Compiler) markInitialized() {
 	c.locals[c.localCount-1].depth = c.scopeDepth
 }
 
-func (c *Compiler) defineVariable(global byte) {
+func (c *Compiler) defineVariable(global int) {
 	if c.scopeDepth > 0 {
 		c.markInitialized()
 		return
 	}
 
-	c.emitOpAndArg(OP_DEFINE_GLOBAL, global)
+	c.emitConstantOp(OP_DEFINE_GLOBAL, OP_DEFINE_GLOBAL_LONG, global)
 }
 
 func (c *Compiler) argumentList() byte {
 	argCount := 0
 
-	if !parser.check(TOKEN_RIGHT_PAREN) {
+	if !c.parser.check(TOKEN_RIGHT_PAREN) {
 		for {
 			c.expression()
 			argCount++
 
 			if argCount == 255 {
-				parser.error("Can't have more than 255 arguments.")
+				c.parser.error("Can't have more than 255 arguments.")
 			}
 
-			if !parser.match(TOKEN_COMMA) {
+			if !c.parser.match(TOKEN_COMMA) {
 				break
 			}
 		}
 	}
 
-	parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after arguments")
+	c.parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after arguments")
 	return byte(argCount)
 }
 
-func (c *Compiler) identifierConstant(name Token) byte {
+func (c *Compiler) identifierConstant(name Token) int {
 	return c.makeConstant(ValueString(name.lexeme))
 }
 
+func syntheticToken(text string) Token {
+	return Token{lexeme: text}
+}
+
 func identifiersEqual(a, b Token) bool {
 	return a.lexeme == b.lexeme
 }
@@ -593,7 +1114,7 @@ func (c *Compiler) declareVariable() {
 		return
 	}
 
-	name := parser.previous
+	name := c.parser.previous
 
 	for i := c.localCount - 1; i >= 0; i-- {
 		local := c.locals[i]
@@ -602,7 +1123,7 @@ func (c *Compiler) declareVariable() {
 		}
 
 		if identifiersEqual(name, local.name) {
-			parser.error("Already a variable with this name in this scope")
+			c.parser.error("Already a variable with this name in this scope")
 		}
 	}
 
@@ -611,11 +1132,11 @@ func (c *Compiler) declareVariable() {
 
 func (c *Compiler) addLocal(name Token) {
 	if c.localCount == UINT8_COUNT {
-		parser.error("Too many local variables in scope")
+		c.parser.error("Too many local variables in scope")
 		return
 	}
 
-	c.locals[c.localCount] = Local{name, -1}
+	c.locals[c.localCount] = Local{name: name, depth: -1}
 	c.localCount++
 }
 
@@ -633,7 +1154,7 @@ func (c *Compiler) emitOpAndArg(op OpCode, arg byte) {
 }
 
 func (c *Compiler) emitByte(item byte) {
-	c.currentChunk().Write(item, parser.previous.line)
+	c.currentChunk().Write(item, c.parser.previous.line)
 }
 
 func (c *Compiler) emitBytes(item1 byte, item2 byte) {
@@ -652,7 +1173,7 @@ func (c *Compiler) emitLoop(start int) {
 
 	offset := c.currentChunk().Count() - start + 2
 	if offset > math.MaxUint16 {
-		parser.error("Loop body too large.")
+		c.parser.error("Loop body too large.")
 	}
 
 	c.emitByte(byte((offset >> 8) & 0xff))
@@ -664,7 +1185,7 @@ func (c *Compiler) patchJump(offset int) {
 	jump := c.currentChunk().Count() - offset - 2
 
 	if jump > math.MaxUint16 {
-		parser.error("Too much code to jump over")
+		c.parser.error("Too much code to jump over")
 	}
 
 	c.currentChunk().code[offset] = byte((jump >> 8) & 0xff)
@@ -672,22 +1193,41 @@ func (c *Compiler) patchJump(offset int) {
 }
 
 func (c *Compiler) emitConstant(value Value) {
-	c.emitOpAndArg(OP_CONSTANT, c.makeConstant(value))
+	c.emitConstantOp(OP_CONSTANT, OP_CONSTANT_LONG, c.makeConstant(value))
 }
 
 func (c *Compiler) emitReturn() {
-	c.emitOp(OP_NIL)
+	if c.kind == TYPE_INITIALIZER {
+		c.emitOpAndArg(OP_GET_LOCAL, 0)
+	} else {
+		c.emitOp(OP_NIL)
+	}
+
 	c.emitOp(OP_RETURN)
 }
 
-func (c *Compiler) makeConstant(value Value) byte {
+func (c *Compiler) makeConstant(value Value) int {
 	constant := c.currentChunk().AddConstant(value)
-	if constant > math.MaxUint8 {
-		parser.error("Too many constants in one chunk")
+	if constant > MAX_LONG_CONSTANT {
+		c.parser.error("Too many constants in one chunk")
 		return 0
 	}
 
-	return byte(constant)
+	return constant
+}
+
+// emitConstantOp emits the short form of an instruction if the constant index
+// fits in a byte, or the long form with a 24-bit operand if not.
+func (c *Compiler) emitConstantOp(op, longOp OpCode, constant int) {
+	if constant <= math.MaxUint8 {
+		c.emitOpAndArg(op, byte(constant))
+		return
+	}
+
+	c.emitOp(longOp)
+	c.emitByte(byte((constant >> 16) & 0xff))
+	c.emitByte(byte((constant >> 8) & 0xff))
+	c.emitByte(byte(constant & 0xff))
 }
 
 func (c *Compiler) end() ValueFunction {
@@ -695,14 +1235,14 @@ func (c *Compiler) end() ValueFunction {
 
 	function := *c.function
 
-	if DEBUG_PRINT_CODE && !parser.hadError {
+	if c.parser.codeOut != nil && !c.parser.hadError {
 		name := function.name
 
 		if function.name == "" {
 			name = "<script>"
 		}
 
-		c.currentChunk().Disassemble(name)
+		c.currentChunk().Disassemble(c.parser.codeOut, name)
 	}
 
 	return function
@@ -716,10 +1256,25 @@ func (c *Compiler) endScope() {
 	c.scopeDepth--
 
 	for c.localCount > 0 && c.locals[c.localCount-1].depth > c.scopeDepth {
-		c.emitOp(OP_POP)
+		if c.locals[c.localCount-1].isCaptured {
+			c.emitOp(OP_CLOSE_UPVALUE)
+		} else {
+			c.emitOp(OP_POP)
+		}
 		c.localCount--
 	}
+}
 
+// discardLocals emits code to pop every local deeper than depth, without
+// forgetting about them, for when we jump out of the middle of a scope.
+func (c *Compiler) discardLocals(depth int) {
+	for i := c.localCount - 1; i >= 0 && c.locals[i].depth > depth; i-- {
+		if c.locals[i].isCaptured {
+			c.emitOp(OP_CLOSE_UPVALUE)
+		} else {
+			c.emitOp(OP_POP)
+		}
+	}
 }
 
 /*
@@ -776,18 +1331,10 @@ func (p *Parser) errorAt(tok Token, message string) {
 
 	p.panicMode = true
 
-	fmt.Fprintf(os.Stderr, "[line %d] Error", tok.line)
-
-	switch tok.kind {
-	case TOKEN_EOF:
-		fmt.Fprintf(os.Stderr, " at end")
-	case TOKEN_ERROR:
-		// do nothing
-	default:
-		fmt.Fprintf(os.Stderr, " at '%s'", tok.lexeme)
-	}
+	diagnostic := newDiagnostic(tok, message)
+	fmt.Fprintln(p.errOut, diagnostic)
 
-	fmt.Fprintf(os.Stderr, ": %s\n", message)
+	p.diagnostics = append(p.diagnostics, diagnostic)
 	p.hadError = true
 
 	// debug.PrintStack()
@@ -808,6 +1355,9 @@ func (p *Parser) synchronize() {
 			TOKEN_FOR,
 			TOKEN_IF,
 			TOKEN_WHILE,
+			TOKEN_SWITCH,
+			TOKEN_BREAK,
+			TOKEN_CONTINUE,
 			TOKEN_PRINT,
 			TOKEN_RETURN:
 			return
@@ -815,5 +1365,7 @@ func (p *Parser) synchronize() {
 		default:
 			// Do nothing.
 		}
+
+		p.advance()
 	}
 }
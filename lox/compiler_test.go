@@ -0,0 +1,219 @@
+package lox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+func compileToBytes(t *testing.T, source string) []byte {
+	function, err := CompileWithDiagnostics(source, io.Discard)
+	if err != nil {
+		t.Errorf("compiling %q: %s", source, err)
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := WriteBytecode(&buf, function); err != nil {
+		t.Errorf("writing bytecode: %s", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestCompileParallel(t *testing.T) {
+	var sources []string
+	for i := 0; i < 32; i++ {
+		sources = append(sources, fmt.Sprintf(`
+			class Counter%d {
+				init(n) { this.n = n; }
+				incr() { this.n = this.n + %d; return this.n; }
+			}
+
+			fun makeAdder(x) {
+				fun add(y) { return x + y; }
+				return add;
+			}
+
+			var c = Counter%d(%d);
+			for (var i = 0; i < %d; i = i + 1) {
+				print makeAdder(i)(c.incr());
+			}
+		`, i, i, i, i, i))
+	}
+
+	// what each program should compile to, done one at a time
+	want := make([][]byte, len(sources))
+	for i, source := range sources {
+		want[i] = compileToBytes(t, source)
+	}
+
+	var wg sync.WaitGroup
+	for round := 0; round < 8; round++ {
+		for i, source := range sources {
+			wg.Add(1)
+			go func(i int, source string) {
+				defer wg.Done()
+
+				got := compileToBytes(t, source)
+				if !bytes.Equal(got, want[i]) {
+					t.Errorf("program %d compiled differently in parallel", i)
+				}
+			}(i, source)
+		}
+	}
+
+	wg.Wait()
+}
+
+func TestCompileErrorsParallel(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// each program has i+1 errors, one per line
+			var source bytes.Buffer
+			for j := 0; j <= i; j++ {
+				source.WriteString("var = 1;\n")
+			}
+
+			_, err := CompileWithDiagnostics(source.String(), io.Discard)
+
+			compileErr, ok := err.(*CompileError)
+			if !ok {
+				t.Errorf("expected *CompileError, got %v", err)
+				return
+			}
+
+			if len(compileErr.Diagnostics) != i+1 {
+				t.Errorf("expected %d diagnostics, got %d", i+1, len(compileErr.Diagnostics))
+			}
+
+			for j, d := range compileErr.Diagnostics {
+				if d.Line != j+1 {
+					t.Errorf("diagnostic %d: expected line %d, got %d", j, j+1, d.Line)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func TestNamesPastConstantByte(t *testing.T) {
+	// fill a chunk's constant pool past 255, so every name after it needs a
+	// long operand
+	var pad bytes.Buffer
+	pad.WriteString("var p = 0;")
+	for i := 1; i <= 300; i++ {
+		fmt.Fprintf(&pad, " p = p + %d;", i)
+	}
+
+	source := fmt.Sprintf(`
+		%[1]s
+
+		class A {
+			init() { %[1]s this.v = 1; }
+			get() { %[1]s return this.v; }
+		}
+
+		class B < A {
+			init() { %[1]s super.init(); this.w = 2; }
+			get() { %[1]s return super.get() + this.w; }
+			bound() { %[1]s var f = super.get; return f(); }
+		}
+
+		var b = B();
+		b.v = b.v + 10;
+		var got = b.get();
+		var bound = b.bound();
+	`, pad.String())
+
+	vm := NewVM()
+	if err := vm.InterpretString(source); err != nil {
+		t.Fatalf("interpret: %s", err)
+	}
+
+	want := map[string]Value{
+		"got":   ValueNumber(13),
+		"bound": ValueNumber(11),
+		"p":     ValueNumber(45150),
+	}
+
+	for name, value := range want {
+		if got := vm.globals[name]; got != value {
+			t.Errorf("expected %s to be %v, got %v", name, value, got)
+		}
+	}
+}
+
+// countOps returns how many times op appears in function's own chunk.
+func countOps(function ValueFunction, op OpCode) int {
+	chunk := function.chunk
+
+	count := 0
+	for offset := 0; offset < chunk.Count(); offset += instructionLength(chunk, offset) {
+		if OpCode(chunk.code[offset]) == op {
+			count++
+		}
+	}
+
+	return count
+}
+
+func TestSwitchEvaluatesSubjectOnce(t *testing.T) {
+	function, err := CompileWithDiagnostics(`
+		fun f() { return 3; }
+		switch (f()) {
+			case 1, 2: print "low";
+			default: print "other";
+			case 3: print "three";
+			case 4, 5, 6: print "high";
+		}
+	`, io.Discard)
+	if err != nil {
+		t.Fatalf("compile: %s", err)
+	}
+
+	// the subject is called once, then compared to each of the six values
+	if got := countOps(function, OP_CALL); got != 1 {
+		t.Errorf("expected the subject to be called once, got %d calls", got)
+	}
+
+	if got := countOps(function, OP_EQUAL); got != 6 {
+		t.Errorf("expected 6 comparisons, got %d", got)
+	}
+}
+
+func TestSwitchCompileErrors(t *testing.T) {
+	tests := map[string]string{
+		"switch (1) { default: print 1; default: print 2; }": "Error at 'default': Can't have more than one 'default' in a switch.",
+		"switch (1) { print 1; }":                            "Error at 'print': Expect 'case' or 'default'.",
+		"switch (1) { case 1 print 1; }":                     "Error at 'print': Expect ':' after case value.",
+		"switch (1) { case 1: continue; }":                   "Error at 'continue': Can't use 'continue' outside of a loop.",
+	}
+
+	for source, want := range tests {
+		_, err := CompileWithDiagnostics(source, io.Discard)
+
+		var compileErr *CompileError
+		if !errors.As(err, &compileErr) || len(compileErr.Diagnostics) == 0 {
+			t.Errorf("%s: expected a compile error, got %v", source, err)
+			continue
+		}
+
+		if got := compileErr.Diagnostics[0].String(); got != "[line 1] "+want {
+			t.Errorf("%s: expected %q, got %q", source, want, got)
+		}
+	}
+
+	// break is fine in a switch, even outside a loop
+	if _, err := CompileWithDiagnostics("switch (1) { case 1: break; }", io.Discard); err != nil {
+		t.Errorf("expected break in a switch to compile, got %v", err)
+	}
+}
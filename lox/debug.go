@@ -1,78 +1,166 @@
 package lox
 
-import "fmt"
-
-const DEBUG_PRINT_CODE = true
-const DEBUG_TRACE_EXECUTION = false
+import (
+	"fmt"
+	"io"
+)
+
+// DebugFlags turn on debugging output, which is written to the VM's stdout.
+type DebugFlags struct {
+	PrintCode      bool // disassemble each function after compiling it
+	TraceExecution bool // print each instruction and the stack as it runs
+}
 
-func (c *Chunk) Disassemble(name string) {
-	fmt.Printf("== %s ==\n", name)
+// Disassemble writes a readable listing of every instruction in the chunk
+// to w.
+func (c *Chunk) Disassemble(w io.Writer, name string) {
+	fmt.Fprintf(w, "== %s ==\n", name)
 
 	for offset := 0; offset < len(c.code); {
-		offset = c.DisassembleInstruction(offset)
+		offset = c.DisassembleInstruction(w, offset)
 	}
 }
 
-func (c *Chunk) DisassembleInstruction(offset int) int {
-	fmt.Printf("%04d ", offset)
+// DisassembleInstruction writes the instruction at offset to w, and returns
+// the offset of the next one.
+func (c *Chunk) DisassembleInstruction(w io.Writer, offset int) int {
+	fmt.Fprintf(w, "%04d ", offset)
 
 	lineNum := c.GetLine(offset)
 	if offset > 0 && lineNum == c.GetLine(offset-1) {
-		fmt.Printf("   | ")
+		fmt.Fprintf(w, "   | ")
 	} else {
-		fmt.Printf("%4d ", lineNum)
+		fmt.Fprintf(w, "%4d ", lineNum)
 	}
 
 	instruction := c.code[offset]
 
 	s := OpCode(instruction).String()
 	if s == "" {
-		fmt.Printf("unknown opcode %d\n", instruction)
+		fmt.Fprintf(w, "unknown opcode %d\n", instruction)
 		return offset + 1
 	}
 
 	switch OpCode(instruction) {
-	case OP_CONSTANT, OP_DEFINE_GLOBAL, OP_SET_GLOBAL, OP_GET_GLOBAL:
-		return constantInstruction(s, c, offset)
+	case OP_CONSTANT, OP_DEFINE_GLOBAL, OP_SET_GLOBAL, OP_GET_GLOBAL,
+		OP_GET_PROPERTY, OP_SET_PROPERTY, OP_GET_SUPER, OP_CLASS, OP_METHOD:
+		return constantInstruction(w, s, c, offset)
+
+	case OP_CONSTANT_LONG, OP_DEFINE_GLOBAL_LONG, OP_SET_GLOBAL_LONG, OP_GET_GLOBAL_LONG,
+		OP_GET_PROPERTY_LONG, OP_SET_PROPERTY_LONG, OP_GET_SUPER_LONG, OP_CLASS_LONG,
+		OP_METHOD_LONG:
+		return constantLongInstruction(w, s, c, offset)
+
+	case OP_GET_LOCAL, OP_SET_LOCAL, OP_GET_UPVALUE, OP_SET_UPVALUE, OP_CALL,
+		OP_BUILD_LIST, OP_BUILD_MAP:
+		return byteInstruction(w, s, c, offset)
 
-	case OP_GET_LOCAL, OP_SET_LOCAL, OP_CALL:
-		return byteInstruction(s, c, offset)
+	case OP_INVOKE, OP_SUPER_INVOKE, OP_INVOKE_LONG, OP_SUPER_INVOKE_LONG:
+		return invokeInstruction(w, s, c, offset)
 
-	case OP_JUMP, OP_JUMP_IF_FALSE, OP_JUMP_IF_TRUE:
-		return jumpInstruction(s, 1, c, offset)
+	case OP_CLOSURE, OP_CLOSURE_LONG:
+		return closureInstruction(w, s, c, offset)
+
+	case OP_JUMP, OP_JUMP_IF_FALSE, OP_JUMP_IF_TRUE, OP_ITER_NEXT:
+		return jumpInstruction(w, s, 1, c, offset)
 
 	case OP_LOOP:
-		return jumpInstruction(s, -1, c, offset)
+		return jumpInstruction(w, s, -1, c, offset)
 
 	default:
-		return simpleInstruction(s, offset)
+		return simpleInstruction(w, s, offset)
 	}
 }
 
-func simpleInstruction(name string, offset int) int {
-	fmt.Printf("%s\n", name)
+func simpleInstruction(w io.Writer, name string, offset int) int {
+	fmt.Fprintf(w, "%s\n", name)
 	return offset + 1
 }
 
-func constantInstruction(name string, chunk *Chunk, offset int) int {
+func constantInstruction(w io.Writer, name string, chunk *Chunk, offset int) int {
 	constant := chunk.code[offset+1]
-	fmt.Printf("%-16s %4d '", name, constant)
-	PrintValue(chunk.constantAt(constant)) // could be improved, probably
-	fmt.Printf("'\n")
+	fmt.Fprintf(w, "%-16s %4d '", name, constant)
+	FprintValue(w, chunk.constantAt(int(constant))) // could be improved, probably
+	fmt.Fprintf(w, "'\n")
 
 	return offset + 2
 }
 
-func byteInstruction(name string, chunk *Chunk, offset int) int {
+func constantLongInstruction(w io.Writer, name string, chunk *Chunk, offset int) int {
+	constant := int(chunk.code[offset+1])<<16 |
+		int(chunk.code[offset+2])<<8 |
+		int(chunk.code[offset+3])
+	fmt.Fprintf(w, "%-16s %4d '", name, constant)
+	FprintValue(w, chunk.constantAt(constant))
+	fmt.Fprintf(w, "'\n")
+
+	return offset + 4
+}
+
+func invokeInstruction(w io.Writer, name string, chunk *Chunk, offset int) int {
+	var constant int
+	switch OpCode(chunk.code[offset]) {
+	case OP_INVOKE_LONG, OP_SUPER_INVOKE_LONG:
+		constant = int(chunk.code[offset+1])<<16 |
+			int(chunk.code[offset+2])<<8 |
+			int(chunk.code[offset+3])
+		offset += 4
+	default:
+		constant = int(chunk.code[offset+1])
+		offset += 2
+	}
+
+	argCount := chunk.code[offset]
+	fmt.Fprintf(w, "%-16s (%d args) %4d '", name, argCount, constant)
+	FprintValue(w, chunk.constantAt(constant))
+	fmt.Fprintf(w, "'\n")
+
+	return offset + 1
+}
+
+func byteInstruction(w io.Writer, name string, chunk *Chunk, offset int) int {
 	slot := chunk.code[offset+1]
-	fmt.Printf("%-16s %4d\n", name, slot)
+	fmt.Fprintf(w, "%-16s %4d\n", name, slot)
 	return offset + 2
 }
 
-func jumpInstruction(name string, sign int, chunk *Chunk, offset int) int {
-	jump := int(chunk.code[offset+1] << 8)
+func jumpInstruction(w io.Writer, name string, sign int, chunk *Chunk, offset int) int {
+	jump := int(chunk.code[offset+1]) << 8
 	jump |= int(chunk.code[offset+2])
-	fmt.Printf("%-16s %4d -> %d\n", name, offset, offset+3+sign*jump)
+	fmt.Fprintf(w, "%-16s %4d -> %d\n", name, offset, offset+3+sign*jump)
 
 	return offset + 3
 }
+
+func closureInstruction(w io.Writer, name string, chunk *Chunk, offset int) int {
+	var constant int
+	if OpCode(chunk.code[offset]) == OP_CLOSURE_LONG {
+		constant = int(chunk.code[offset+1])<<16 |
+			int(chunk.code[offset+2])<<8 |
+			int(chunk.code[offset+3])
+		offset += 4
+	} else {
+		constant = int(chunk.code[offset+1])
+		offset += 2
+	}
+
+	fmt.Fprintf(w, "%-16s %4d ", name, constant)
+	FprintValue(w, chunk.constantAt(constant))
+	fmt.Fprintf(w, "\n")
+
+	function := chunk.constantAt(constant).(ValueFunction)
+	for j := 0; j < function.upvalueCount; j++ {
+		isLocal := chunk.code[offset]
+		index := chunk.code[offset+1]
+
+		kind := "upvalue"
+		if isLocal == 1 {
+			kind = "local"
+		}
+
+		fmt.Fprintf(w, "%04d    |                     %s %d\n", offset, kind, index)
+		offset += 2
+	}
+
+	return offset
+}
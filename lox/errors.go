@@ -0,0 +1,140 @@
+package lox
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var InterpretCompileError = errors.New("compile error")
+var InterpretRuntimeError = errors.New("runtime error")
+var ErrInstructionLimit = errors.New("instruction limit exceeded")
+
+// CompileError is returned when compilation fails, and holds every
+// diagnostic the parser reported. It matches InterpretCompileError with
+// errors.Is.
+type CompileError struct {
+	Diagnostics []Diagnostic
+}
+
+type Diagnostic struct {
+	Line    int
+	Column  int
+	Lexeme  string
+	Message string
+
+	// where is the " at 'foo'" bit of the message, which depends on the kind
+	// of token
+	where string
+}
+
+// RuntimeError is returned when the VM hits an error while running, along
+// with a trace of the call frames that were active, innermost first. It
+// matches InterpretRuntimeError with errors.Is.
+type RuntimeError struct {
+	Message string
+	Trace   []TraceFrame
+}
+
+type TraceFrame struct {
+	Line     int
+	Function string // empty for top-level code
+}
+
+// ExecutionLimitError is returned when the VM stops early, either because
+// its context is done or because it ran out of instructions. Err is the
+// reason: the context's error, or ErrInstructionLimit. It also matches
+// InterpretRuntimeError with errors.Is.
+type ExecutionLimitError struct {
+	Err  error
+	Line int
+}
+
+// MemoryLimitError is returned when a script tries to allocate more memory
+// than the VM's limit allows. It matches InterpretRuntimeError with
+// errors.Is.
+type MemoryLimitError struct {
+	Limit int
+	Line  int
+}
+
+func newDiagnostic(tok Token, message string) Diagnostic {
+	d := Diagnostic{
+		Line:    tok.line,
+		Column:  tok.column,
+		Message: message,
+	}
+
+	switch tok.kind {
+	case TOKEN_EOF:
+		d.where = " at end"
+	case TOKEN_ERROR:
+		// the lexeme is the error message, so there's nothing useful to say
+	default:
+		d.Lexeme = tok.lexeme
+		d.where = fmt.Sprintf(" at '%s'", tok.lexeme)
+	}
+
+	return d
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("[line %d] Error%s: %s", d.Line, d.where, d.Message)
+}
+
+func (e *CompileError) Error() string {
+	lines := make([]string, 0, len(e.Diagnostics))
+	for _, d := range e.Diagnostics {
+		lines = append(lines, d.String())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (e *CompileError) Is(target error) bool {
+	return target == InterpretCompileError
+}
+
+func (e *RuntimeError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Message)
+
+	for _, frame := range e.Trace {
+		b.WriteString("\n")
+		b.WriteString(frame.String())
+	}
+
+	return b.String()
+}
+
+func (e *RuntimeError) Is(target error) bool {
+	return target == InterpretRuntimeError
+}
+
+func (e *MemoryLimitError) Error() string {
+	return fmt.Sprintf("Memory limit of %d bytes exceeded.\n[line %d]", e.Limit, e.Line)
+}
+
+func (e *MemoryLimitError) Is(target error) bool {
+	return target == InterpretRuntimeError
+}
+
+func (e *ExecutionLimitError) Error() string {
+	return fmt.Sprintf("Execution stopped: %s.\n[line %d]", e.Err, e.Line)
+}
+
+func (e *ExecutionLimitError) Is(target error) bool {
+	return target == InterpretRuntimeError
+}
+
+func (e *ExecutionLimitError) Unwrap() error {
+	return e.Err
+}
+
+func (f TraceFrame) String() string {
+	if f.Function == "" {
+		return fmt.Sprintf("[line %d] in script", f.Line)
+	}
+
+	return fmt.Sprintf("[line %d] in %s()", f.Line, f.Function)
+}
@@ -0,0 +1,230 @@
+package lox
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// This is the API for Go programs that embed the VM: getting values in and
+// out, and calling back and forth between Go and Lox.
+
+// SetGlobal defines a global variable, overwriting it if it already exists.
+func (vm *VM) SetGlobal(name string, value Value) {
+	vm.globals[name] = value
+}
+
+// GetGlobal returns the value of a global variable, and whether it exists.
+func (vm *VM) GetGlobal(name string) (Value, bool) {
+	value, ok := vm.globals[name]
+	return value, ok
+}
+
+// RegisterNative makes a Go function callable from Lox as a global with the
+// given name. Calls with the wrong number of arguments are a runtime error,
+// unless arity is VARIADIC.
+func (vm *VM) RegisterNative(name string, arity int, function NativeFn) {
+	vm.defineNative(name, arity, function)
+}
+
+// Call calls the global function with the given name, converting the
+// arguments with ToValue and the result with FromValue.
+func (vm *VM) Call(name string, args ...any) (any, error) {
+	callee, ok := vm.globals[name]
+	if !ok {
+		return nil, fmt.Errorf("undefined function '%s'", name)
+	}
+
+	values := make([]Value, 0, len(args))
+	for _, arg := range args {
+		value, err := ToValue(arg)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+	}
+
+	result, err := vm.CallValue(callee, values...)
+	if err != nil {
+		return nil, err
+	}
+
+	return FromValue(result), nil
+}
+
+// CallValue calls any callable Lox value (a function, bound method, class or
+// native) with the given arguments and returns its result. It's fine to call
+// this from inside a native: if the call fails, only the call is unwound, and
+// the native can decide what to do with the error.
+func (vm *VM) CallValue(callee Value, args ...Value) (Value, error) {
+	sp, base := vm.sp, vm.frameCount
+
+	vm.push(callee)
+	for _, arg := range args {
+		vm.push(arg)
+	}
+
+	if err := vm.callValue(callee, len(args)); err != nil {
+		vm.unwind(sp, base)
+		return nil, err
+	}
+
+	// calling a Lox function pushes a frame that we need to run; natives
+	// (and classes without initializers) are already done
+	if vm.frameCount > base {
+		if err := vm.run(base); err != nil {
+			vm.unwind(sp, base)
+			return nil, err
+		}
+	}
+
+	return vm.pop(), nil
+}
+
+// ToValue converts a Go value into a Lox one. Any Go number becomes a Lox
+// number, a []any becomes a list, a map[string]any becomes a map, and Values
+// are passed through unchanged. A slice or map that contains itself is an
+// error, since a list or map built from it would never finish.
+func ToValue(v any) (Value, error) {
+	return toValue(v, nil)
+}
+
+// toValue does the work for ToValue, keeping track of the slices and maps
+// we're in the middle of converting, by pointer, to catch cycles.
+func toValue(v any, converting []uintptr) (Value, error) {
+	switch x := v.(type) {
+	case nil:
+		return ValueNil(0), nil
+	case Value:
+		return x, nil
+	case bool:
+		return ValueBool(x), nil
+	case string:
+		return ValueString(x), nil
+	case []any:
+		// an empty slice can't hold itself, but can share a pointer with one
+		// that does (like x[:0]), so don't track it
+		if len(x) == 0 {
+			return NewList([]Value{}), nil
+		}
+
+		ptr := reflect.ValueOf(x).Pointer()
+		if isConverting(ptr, converting) {
+			return nil, fmt.Errorf("cannot convert a []any that contains itself")
+		}
+
+		converting = append(converting, ptr)
+
+		items := make([]Value, len(x))
+		for i, item := range x {
+			value, err := toValue(item, converting)
+			if err != nil {
+				return nil, err
+			}
+
+			items[i] = value
+		}
+
+		return NewList(items), nil
+	case map[string]any:
+		ptr := reflect.ValueOf(x).Pointer()
+		if isConverting(ptr, converting) {
+			return nil, fmt.Errorf("cannot convert a map[string]any that contains itself")
+		}
+
+		converting = append(converting, ptr)
+
+		// Go maps don't have an order, so sort the keys to be predictable
+		keys := make([]string, 0, len(x))
+		for key := range x {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		m := NewMap()
+		for _, key := range keys {
+			value, err := toValue(x[key], converting)
+			if err != nil {
+				return nil, err
+			}
+
+			m.set(ValueString(key), value)
+		}
+
+		return m, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return ValueNumber(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return ValueNumber(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return ValueNumber(rv.Float()), nil
+	}
+
+	return nil, fmt.Errorf("cannot convert %T to a Lox value", v)
+}
+
+func isConverting(ptr uintptr, converting []uintptr) bool {
+	for _, seen := range converting {
+		if seen == ptr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FromValue converts a Lox value into the natural Go type: nil, bool,
+// float64, string, []any for lists, or map[any]any for maps. Anything else
+// (functions, instances, etc.) is returned as the Value itself, as is a list
+// or map that contains itself, since there's no Go value to convert it to.
+func FromValue(v Value) any {
+	return fromValue(v, nil)
+}
+
+// fromValue does the work for FromValue, keeping track of the lists and maps
+// we're in the middle of converting, like printValue does.
+func fromValue(v Value, converting []Value) any {
+	switch x := v.(type) {
+	case ValueNil:
+		return nil
+	case ValueBool:
+		return bool(x)
+	case ValueNumber:
+		return float64(x)
+	case ValueString:
+		return string(x)
+	case *ValueList:
+		if isOneOf(x, converting) {
+			return v
+		}
+
+		converting = append(converting, x)
+
+		items := make([]any, len(x.items))
+		for i, item := range x.items {
+			items[i] = fromValue(item, converting)
+		}
+
+		return items
+	case *ValueMap:
+		if isOneOf(x, converting) {
+			return v
+		}
+
+		converting = append(converting, x)
+
+		m := make(map[any]any, len(x.entries))
+		for _, entry := range x.entries {
+			m[fromValue(entry.key, converting)] = fromValue(entry.value, converting)
+		}
+
+		return m
+	default:
+		return v
+	}
+}
@@ -0,0 +1,75 @@
+package lox
+
+import (
+	"io"
+	"testing"
+)
+
+func TestFromValueCycles(t *testing.T) {
+	vm := NewVM()
+	vm.SetStderr(io.Discard)
+
+	err := vm.InterpretString(`
+		var list = [1, 2];
+		push(list, list);
+
+		var map = {"a": 1};
+		map["self"] = map;
+	`)
+	if err != nil {
+		t.Fatalf("interpret: %s", err)
+	}
+
+	list, _ := vm.GetGlobal("list")
+
+	items, ok := FromValue(list).([]any)
+	if !ok || len(items) != 3 {
+		t.Fatalf("expected a list of 3 items, got %v", items)
+	}
+
+	if _, isValue := items[2].(*ValueList); !isValue {
+		t.Errorf("expected the cycle to come back as a *ValueList, got %T", items[2])
+	}
+
+	m, _ := vm.GetGlobal("map")
+
+	entries, ok := FromValue(m).(map[any]any)
+	if !ok || len(entries) != 2 {
+		t.Fatalf("expected a map of 2 entries, got %v", entries)
+	}
+
+	if _, isValue := entries["self"].(*ValueMap); !isValue {
+		t.Errorf("expected the cycle to come back as a *ValueMap, got %T", entries["self"])
+	}
+}
+
+func TestToValueCycles(t *testing.T) {
+	list := []any{1, 2, nil}
+	list[2] = list
+
+	if _, err := ToValue(list); err == nil {
+		t.Errorf("expected an error converting a slice that contains itself")
+	}
+
+	m := map[string]any{"a": 1}
+	m["nested"] = []any{map[string]any{"self": m}}
+
+	if _, err := ToValue(m); err == nil {
+		t.Errorf("expected an error converting a map that contains itself")
+	}
+
+	// the same slice twice, side by side, isn't a cycle, nor is an empty
+	// slice sharing its backing array with the one it's in
+	shared := []any{1, 2}
+	outer := []any{shared, shared, nil}
+	outer[2] = outer[:0]
+
+	value, err := ToValue(outer)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if got := value.(*ValueList).items; len(got) != 3 || len(got[2].(*ValueList).items) != 0 {
+		t.Errorf("expected [[1, 2], [1, 2], []], got %v", value)
+	}
+}
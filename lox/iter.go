@@ -0,0 +1,168 @@
+package lox
+
+import (
+	"fmt"
+	"math"
+	"unicode/utf8"
+)
+
+// This is the iteration protocol behind for-in loops. Anything that
+// implements Iterable can be looped over, so the host can make its own Value
+// types iterable too.
+
+// Iterator produces the values for a for-in loop one at a time. Next returns
+// false once there's nothing left.
+type Iterator interface {
+	Next() (Value, bool)
+}
+
+// Iterable is a Value that can be looped over with for-in.
+type Iterable interface {
+	Value
+	Iterator() Iterator
+}
+
+// ValueRange is what range() returns: numbers from start up to (but not
+// including) end, going up by step, which may be negative.
+type ValueRange struct {
+	start float64
+	end   float64
+	step  float64
+}
+
+// valueIterator is the iterator a for-in loop keeps on the stack while it
+// runs. It's never visible from Lox.
+type valueIterator struct {
+	Iterator
+}
+
+func (v ValueRange) Equals(other Value) bool {
+	x, isRange := other.(ValueRange)
+	return isRange && v == x
+}
+
+func (v *valueIterator) Equals(other Value) bool {
+	x, isIterator := other.(*valueIterator)
+	return isIterator && v == x
+}
+
+// Strings iterate over their characters, lists over their items, and maps
+// over their keys, in insertion order.
+func (v ValueString) Iterator() Iterator {
+	return &stringIterator{s: string(v)}
+}
+
+func (v *ValueList) Iterator() Iterator {
+	return &listIterator{list: v}
+}
+
+func (v *ValueMap) Iterator() Iterator {
+	return &mapIterator{m: v}
+}
+
+func (v ValueRange) Iterator() Iterator {
+	return &rangeIterator{r: v}
+}
+
+type stringIterator struct {
+	s      string
+	offset int
+}
+
+func (it *stringIterator) Next() (Value, bool) {
+	if it.offset >= len(it.s) {
+		return nil, false
+	}
+
+	_, size := utf8.DecodeRuneInString(it.s[it.offset:])
+	char := it.s[it.offset : it.offset+size]
+	it.offset += size
+
+	return ValueString(char), true
+}
+
+// The list and map iterators look things up by position each time, so that
+// changing the collection in the middle of a loop can't go out of bounds.
+type listIterator struct {
+	list *ValueList
+	i    int
+}
+
+func (it *listIterator) Next() (Value, bool) {
+	if it.i >= len(it.list.items) {
+		return nil, false
+	}
+
+	it.i++
+	return it.list.items[it.i-1], true
+}
+
+type mapIterator struct {
+	m *ValueMap
+	i int
+}
+
+func (it *mapIterator) Next() (Value, bool) {
+	if it.i >= len(it.m.entries) {
+		return nil, false
+	}
+
+	it.i++
+	return it.m.entries[it.i-1].key, true
+}
+
+// rangeIterator counts steps rather than adding step up as it goes, so that
+// floating point error doesn't pile up: range(0, 1, 0.1) has ten numbers, not
+// eleven.
+type rangeIterator struct {
+	r ValueRange
+	i int
+}
+
+func (it *rangeIterator) Next() (Value, bool) {
+	n := it.r.start + float64(it.i)*it.r.step
+	if (it.r.step > 0 && n >= it.r.end) || (it.r.step < 0 && n <= it.r.end) {
+		return nil, false
+	}
+
+	it.i++
+	return ValueNumber(n), true
+}
+
+// range(end), range(start, end) or range(start, end, step)
+func rangeNative(args []Value) (Value, error) {
+	if len(args) < 1 || len(args) > 3 {
+		return nil, fmt.Errorf("Expected 1 to 3 arguments but got %d.", len(args))
+	}
+
+	nums := make([]float64, len(args))
+	for i := range args {
+		n, err := numberArg("range", args, i)
+		if err != nil {
+			return nil, err
+		}
+
+		nums[i] = n
+	}
+
+	r := ValueRange{start: 0, step: 1}
+	switch len(nums) {
+	case 1:
+		r.end = nums[0]
+	case 2:
+		r.start, r.end = nums[0], nums[1]
+	case 3:
+		r.start, r.end, r.step = nums[0], nums[1], nums[2]
+	}
+
+	if r.step == 0 {
+		return nil, fmt.Errorf("Range step can't be zero.")
+	}
+
+	// a range with NaN in it would never finish
+	if math.IsNaN(r.start) || math.IsNaN(r.end) || math.IsNaN(r.step) {
+		return nil, fmt.Errorf("Range arguments can't be NaN.")
+	}
+
+	return r, nil
+}
@@ -0,0 +1,106 @@
+package lox
+
+import (
+	"context"
+	"fmt"
+	"unsafe"
+)
+
+// How often (in instructions) the VM checks whether its context is done.
+// Checking on every instruction would be needlessly slow.
+const CONTEXT_CHECK_INTERVAL = 1024
+
+// Rough sizes of the things we count against the memory limit. These don't
+// need to be exact, just in the right ballpark.
+const (
+	sizeofValue       = int(unsafe.Sizeof(Value(nil)))
+	sizeofClosure     = int(unsafe.Sizeof(ValueClosure{}))
+	sizeofUpvalue     = int(unsafe.Sizeof(ValueUpvalue{})) + int(unsafe.Sizeof(&ValueUpvalue{}))
+	sizeofClass       = int(unsafe.Sizeof(ValueClass{}))
+	sizeofInstance    = int(unsafe.Sizeof(ValueInstance{}))
+	sizeofBoundMethod = int(unsafe.Sizeof(ValueBoundMethod{}))
+	sizeofList        = int(unsafe.Sizeof(ValueList{}))
+	sizeofMap         = int(unsafe.Sizeof(ValueMap{}))
+	sizeofIterator    = int(unsafe.Sizeof(valueIterator{})) + int(unsafe.Sizeof(rangeIterator{}))
+	sizeofMapEntry    = int(unsafe.Sizeof(mapEntry{})) + sizeofValue + int(unsafe.Sizeof(0))
+	sizeofField       = int(unsafe.Sizeof("")) + sizeofValue
+)
+
+// SetContext makes the VM stop with an *ExecutionLimitError once ctx is
+// cancelled or its deadline passes.
+func (vm *VM) SetContext(ctx context.Context) {
+	vm.ctx = ctx
+}
+
+// SetInstructionLimit limits the number of instructions the VM will execute,
+// counting from now; zero means no limit. Going over the limit stops the VM
+// with an *ExecutionLimitError.
+func (vm *VM) SetInstructionLimit(limit int) {
+	vm.instructionLimit = limit
+	vm.instructionCount = 0
+}
+
+// SetMemoryLimit limits the number of bytes the VM will allocate for strings
+// and objects, counting from now; zero means no limit. This is a budget for
+// everything allocated, not just what's still in use. Going over the limit
+// stops the VM with a *MemoryLimitError.
+func (vm *VM) SetMemoryLimit(limit int) {
+	vm.memoryLimit = limit
+	vm.bytesAllocated = 0
+}
+
+// BytesAllocated returns roughly how many bytes the VM has allocated since
+// the memory limit was last set.
+func (vm *VM) BytesAllocated() int {
+	return vm.bytesAllocated
+}
+
+// allocate records that we're about to allocate size bytes, and returns an
+// error instead if doing so would put us over the memory limit.
+func (vm *VM) allocate(size int) error {
+	if vm.memoryLimit > 0 && vm.bytesAllocated+size > vm.memoryLimit {
+		err := &MemoryLimitError{Limit: vm.memoryLimit, Line: vm.currentLine()}
+		fmt.Fprintln(vm.stderr, err)
+		return err
+	}
+
+	vm.bytesAllocated += size
+	return nil
+}
+
+// checkLimits is called before every instruction, and returns an error if the
+// VM should stop running.
+func (vm *VM) checkLimits() error {
+	vm.instructionCount++
+
+	if vm.instructionLimit > 0 && vm.instructionCount > vm.instructionLimit {
+		return vm.limitError(ErrInstructionLimit)
+	}
+
+	if vm.instructionCount%CONTEXT_CHECK_INTERVAL == 0 {
+		if err := vm.ctx.Err(); err != nil {
+			return vm.limitError(err)
+		}
+	}
+
+	return nil
+}
+
+func (vm *VM) limitError(reason error) error {
+	err := &ExecutionLimitError{Err: reason, Line: vm.currentLine()}
+
+	fmt.Fprintln(vm.stderr, err)
+
+	return err
+}
+
+// currentLine is the line of the instruction we're about to execute, or zero
+// if we're not running any Lox code (like when the host calls a class).
+func (vm *VM) currentLine() int {
+	if vm.frameCount == 0 {
+		return 0
+	}
+
+	frame := vm.currentFrame()
+	return frame.closure.function.chunk.GetLine(frame.ip)
+}
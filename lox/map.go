@@ -0,0 +1,86 @@
+package lox
+
+import (
+	"errors"
+	"math"
+)
+
+// Map keys are looked up with a Go map keyed on the Value itself. That only
+// works for the value types that are comparable in Go and whose Go equality
+// agrees with Equals: numbers, strings, bools and nil. NaN isn't equal to
+// itself, so it's out too; Go already treats 0 and -0 as the same key.
+// Everything else compares by identity in Lox, and allowing it as a key would
+// mean you could never look up a list by its contents, which is more
+// confusing than useful.
+
+var errUnhashable = errors.New("Map keys must be numbers, strings, booleans or nil.")
+var errNaNKey = errors.New("NaN can't be used as a map key.")
+
+// hashable returns an error if v can't be used as a map key.
+func hashable(v Value) error {
+	switch x := v.(type) {
+	case ValueNumber:
+		if math.IsNaN(float64(x)) {
+			return errNaNKey
+		}
+
+		return nil
+	case ValueString, ValueBool, ValueNil:
+		return nil
+	}
+
+	return errUnhashable
+}
+
+// get returns the value for key, if there is one. Unhashable keys are never
+// there (and some of them would make the Go map panic).
+func (m *ValueMap) get(key Value) (Value, bool) {
+	if hashable(key) != nil {
+		return nil, false
+	}
+
+	i, ok := m.index[key]
+	if !ok {
+		return nil, false
+	}
+
+	return m.entries[i].value, true
+}
+
+// set adds or replaces the value for key, and reports whether it was new.
+// The caller is responsible for checking the key is hashable.
+func (m *ValueMap) set(key, value Value) bool {
+	if i, ok := m.index[key]; ok {
+		m.entries[i].value = value
+		return false
+	}
+
+	m.index[key] = len(m.entries)
+	m.entries = append(m.entries, mapEntry{key, value})
+	return true
+}
+
+// delete removes key from the map, and reports whether it was there.
+func (m *ValueMap) delete(key Value) bool {
+	if hashable(key) != nil {
+		return false
+	}
+
+	i, ok := m.index[key]
+	if !ok {
+		return false
+	}
+
+	delete(m.index, key)
+
+	copy(m.entries[i:], m.entries[i+1:])
+	m.entries[len(m.entries)-1] = mapEntry{}
+	m.entries = m.entries[:len(m.entries)-1]
+
+	// everything after the deleted entry moved down one
+	for j := i; j < len(m.entries); j++ {
+		m.index[m.entries[j].key] = j
+	}
+
+	return true
+}
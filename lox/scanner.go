@@ -8,7 +8,10 @@ const (
 	TOKEN_RIGHT_PAREN
 	TOKEN_LEFT_BRACE
 	TOKEN_RIGHT_BRACE
+	TOKEN_LEFT_BRACKET
+	TOKEN_RIGHT_BRACKET
 	TOKEN_COMMA
+	TOKEN_COLON
 	TOKEN_DOT
 	TOKEN_MINUS
 	TOKEN_PLUS
@@ -33,17 +36,23 @@ const (
 
 	// Keywords
 	TOKEN_AND
+	TOKEN_BREAK
+	TOKEN_CASE
 	TOKEN_CLASS
+	TOKEN_CONTINUE
+	TOKEN_DEFAULT
 	TOKEN_ELSE
 	TOKEN_FALSE
 	TOKEN_FOR
 	TOKEN_FUN
 	TOKEN_IF
+	TOKEN_IN
 	TOKEN_NIL
 	TOKEN_OR
 	TOKEN_PRINT
 	TOKEN_RETURN
 	TOKEN_SUPER
+	TOKEN_SWITCH
 	TOKEN_THIS
 	TOKEN_TRUE
 	TOKEN_VAR
@@ -54,16 +63,19 @@ const (
 )
 
 type Scanner struct {
-	source  string
-	start   int
-	current int
-	line    int
+	source      string
+	start       int
+	current     int
+	line        int
+	lineStart   int // offset of the first character on the current line
+	startColumn int
 }
 
 type Token struct {
 	kind   TokenType
 	lexeme string
 	line   int
+	column int
 }
 
 var reservedWords map[string]TokenType
@@ -71,22 +83,28 @@ var tokenNames map[TokenType]string
 
 func init() {
 	reservedWords = map[string]TokenType{
-		"and":    TOKEN_AND,
-		"class":  TOKEN_CLASS,
-		"else":   TOKEN_ELSE,
-		"false":  TOKEN_FALSE,
-		"for":    TOKEN_FOR,
-		"fun":    TOKEN_FUN,
-		"if":     TOKEN_IF,
-		"nil":    TOKEN_NIL,
-		"or":     TOKEN_OR,
-		"print":  TOKEN_PRINT,
-		"return": TOKEN_RETURN,
-		"super":  TOKEN_SUPER,
-		"this":   TOKEN_THIS,
-		"true":   TOKEN_TRUE,
-		"var":    TOKEN_VAR,
-		"while":  TOKEN_WHILE,
+		"and":      TOKEN_AND,
+		"break":    TOKEN_BREAK,
+		"case":     TOKEN_CASE,
+		"class":    TOKEN_CLASS,
+		"continue": TOKEN_CONTINUE,
+		"default":  TOKEN_DEFAULT,
+		"else":     TOKEN_ELSE,
+		"false":    TOKEN_FALSE,
+		"for":      TOKEN_FOR,
+		"fun":      TOKEN_FUN,
+		"if":       TOKEN_IF,
+		"in":       TOKEN_IN,
+		"nil":      TOKEN_NIL,
+		"or":       TOKEN_OR,
+		"print":    TOKEN_PRINT,
+		"return":   TOKEN_RETURN,
+		"super":    TOKEN_SUPER,
+		"switch":   TOKEN_SWITCH,
+		"this":     TOKEN_THIS,
+		"true":     TOKEN_TRUE,
+		"var":      TOKEN_VAR,
+		"while":    TOKEN_WHILE,
 	}
 
 	tokenNames = map[TokenType]string{
@@ -94,7 +112,10 @@ func init() {
 		TOKEN_RIGHT_PAREN:   ")",
 		TOKEN_LEFT_BRACE:    "{",
 		TOKEN_RIGHT_BRACE:   "}",
+		TOKEN_LEFT_BRACKET:  "[",
+		TOKEN_RIGHT_BRACKET: "]",
 		TOKEN_COMMA:         ",",
+		TOKEN_COLON:         ":",
 		TOKEN_DOT:           ".",
 		TOKEN_MINUS:         "-",
 		TOKEN_PLUS:          "+",
@@ -113,17 +134,23 @@ func init() {
 		TOKEN_STRING:        "<string>",
 		TOKEN_NUMBER:        "<number>",
 		TOKEN_AND:           "&&",
+		TOKEN_BREAK:         "break",
+		TOKEN_CASE:          "case",
 		TOKEN_CLASS:         "class",
+		TOKEN_CONTINUE:      "continue",
+		TOKEN_DEFAULT:       "default",
 		TOKEN_ELSE:          "else",
 		TOKEN_FALSE:         "false",
 		TOKEN_FOR:           "for",
 		TOKEN_FUN:           "fun",
 		TOKEN_IF:            "if",
+		TOKEN_IN:            "in",
 		TOKEN_NIL:           "nil",
 		TOKEN_OR:            "or",
 		TOKEN_PRINT:         "print",
 		TOKEN_RETURN:        "return",
 		TOKEN_SUPER:         "super",
+		TOKEN_SWITCH:        "switch",
 		TOKEN_THIS:          "this",
 		TOKEN_TRUE:          "true",
 		TOKEN_VAR:           "var",
@@ -151,6 +178,7 @@ func isAlpha(c byte) bool {
 func (s *Scanner) ScanToken() Token {
 	s.skipWhitespace()
 	s.start = s.current
+	s.startColumn = s.start - s.lineStart + 1
 
 	if s.isAtEnd() {
 		return s.makeToken(TOKEN_EOF)
@@ -175,10 +203,16 @@ func (s *Scanner) ScanToken() Token {
 		return s.makeToken(TOKEN_LEFT_BRACE)
 	case '}':
 		return s.makeToken(TOKEN_RIGHT_BRACE)
+	case '[':
+		return s.makeToken(TOKEN_LEFT_BRACKET)
+	case ']':
+		return s.makeToken(TOKEN_RIGHT_BRACKET)
 	case ';':
 		return s.makeToken(TOKEN_SEMICOLON)
 	case ',':
 		return s.makeToken(TOKEN_COMMA)
+	case ':':
+		return s.makeToken(TOKEN_COLON)
 	case '.':
 		return s.makeToken(TOKEN_DOT)
 	case '-':
@@ -235,8 +269,8 @@ func (s *Scanner) skipWhitespace() {
 			s.advance()
 			break
 		case '\n':
-			s.line++
 			s.advance()
+			s.newline()
 			break
 		case '/':
 			if s.peekNext() == '/' {
@@ -255,10 +289,12 @@ func (s *Scanner) skipWhitespace() {
 
 func (s *Scanner) string() Token {
 	for s.peek() != '"' && !s.isAtEnd() {
-		if s.peek() == '\n' {
-			s.line++
-		}
+		isNewline := s.peek() == '\n'
 		s.advance()
+
+		if isNewline {
+			s.newline()
+		}
 	}
 
 	if s.isAtEnd() {
@@ -307,6 +343,11 @@ func (s *Scanner) identifierType() TokenType {
 	return TOKEN_IDENTIFIER
 }
 
+func (s *Scanner) newline() {
+	s.line++
+	s.lineStart = s.current
+}
+
 func (s *Scanner) isAtEnd() bool {
 	return s.current >= len(s.source)
 }
@@ -316,6 +357,7 @@ func (s *Scanner) makeToken(kind TokenType) Token {
 		kind:   kind,
 		lexeme: string(s.source[s.start:s.current]),
 		line:   s.line,
+		column: s.startColumn,
 	}
 }
 
@@ -324,6 +366,7 @@ func (s *Scanner) errorToken(msg string) Token {
 		kind:   TOKEN_ERROR,
 		lexeme: msg,
 		line:   s.line,
+		column: s.startColumn,
 	}
 }
 
@@ -0,0 +1,558 @@
+package lox
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The standard library: native functions that every VM starts out with.
+// String functions count characters, not bytes. Natives that make new strings
+// or make lists bigger are methods on the VM, so that they count against its
+// memory limit.
+
+func (vm *VM) defineStdlib() {
+	vm.defineNative("clock", 0, vm.clockNative)
+
+	// strings
+	vm.defineNative("len", 1, lenNative)
+	vm.defineNative("substr", VARIADIC, vm.substrNative)
+	vm.defineNative("indexOf", 2, indexOfNative)
+	vm.defineNative("upper", 1, vm.upperNative)
+	vm.defineNative("lower", 1, vm.lowerNative)
+	vm.defineNative("trim", 1, vm.trimNative)
+	vm.defineNative("split", 2, vm.splitNative)
+
+	// lists
+	vm.defineNative("push", 2, vm.pushNative)
+	vm.defineNative("pop", 1, popNative)
+	vm.defineNative("insert", 3, vm.insertNative)
+	vm.defineNative("remove", 2, removeNative)
+
+	// maps
+	vm.defineNative("has", 2, hasNative)
+	vm.defineNative("keys", 1, vm.keysNative)
+	vm.defineNative("values", 1, vm.valuesNative)
+	vm.defineNative("delete", 2, deleteNative)
+
+	// numbers
+	vm.defineNative("floor", 1, mathNative("floor", math.Floor))
+	vm.defineNative("ceil", 1, mathNative("ceil", math.Ceil))
+	vm.defineNative("sqrt", 1, mathNative("sqrt", math.Sqrt))
+	vm.defineNative("abs", 1, mathNative("abs", math.Abs))
+	vm.defineNative("pow", 2, powNative)
+	vm.defineNative("min", VARIADIC, extremeNative("min", math.Min))
+	vm.defineNative("max", VARIADIC, extremeNative("max", math.Max))
+	vm.defineNative("random", 0, vm.randomNative)
+	vm.defineNative("range", VARIADIC, rangeNative)
+
+	// conversions
+	vm.defineNative("str", 1, vm.strNative)
+	vm.defineNative("num", 1, numNative)
+	vm.defineNative("type", 1, typeNative)
+
+	// input
+	vm.defineNative("input", 0, vm.inputNative)
+}
+
+// SetStdin sets where input() reads from.
+func (vm *VM) SetStdin(r io.Reader) {
+	vm.stdin = bufio.NewReader(r)
+}
+
+// SetRandomSeed seeds the generator behind random(), so that scripts can be
+// made repeatable.
+func (vm *VM) SetRandomSeed(seed int64) {
+	vm.rng = rand.New(rand.NewSource(seed))
+}
+
+// argument helpers
+func numberArg(fn string, args []Value, i int) (float64, error) {
+	n, ok := args[i].(ValueNumber)
+	if !ok {
+		return 0, fmt.Errorf("Argument %d to '%s' must be a number.", i+1, fn)
+	}
+
+	return float64(n), nil
+}
+
+func stringArg(fn string, args []Value, i int) (string, error) {
+	s, ok := args[i].(ValueString)
+	if !ok {
+		return "", fmt.Errorf("Argument %d to '%s' must be a string.", i+1, fn)
+	}
+
+	return string(s), nil
+}
+
+func listArg(fn string, args []Value, i int) (*ValueList, error) {
+	list, ok := args[i].(*ValueList)
+	if !ok {
+		return nil, fmt.Errorf("Argument %d to '%s' must be a list.", i+1, fn)
+	}
+
+	return list, nil
+}
+
+func mapArg(fn string, args []Value, i int) (*ValueMap, error) {
+	m, ok := args[i].(*ValueMap)
+	if !ok {
+		return nil, fmt.Errorf("Argument %d to '%s' must be a map.", i+1, fn)
+	}
+
+	return m, nil
+}
+
+// listIndex turns a Lox index into a Go one, counting negative indices from
+// the end. If forInsert is true, the index just past the end is ok too.
+func listIndex(list *ValueList, index Value, forInsert bool) (int, error) {
+	n, ok := index.(ValueNumber)
+	if !ok {
+		return 0, fmt.Errorf("List index must be a number.")
+	}
+
+	if n != ValueNumber(math.Trunc(float64(n))) {
+		return 0, fmt.Errorf("List index must be a whole number.")
+	}
+
+	i := int(n)
+	if i < 0 {
+		i += len(list.items)
+	}
+
+	limit := len(list.items)
+	if forInsert {
+		limit++
+	}
+
+	if i < 0 || i >= limit {
+		return 0, fmt.Errorf("List index %g out of range for list of length %d.", n, len(list.items))
+	}
+
+	return i, nil
+}
+
+// intArg is a number argument that has to be a whole number, like an index.
+func intArg(fn string, args []Value, i int) (int, error) {
+	n, err := numberArg(fn, args, i)
+	if err != nil {
+		return 0, err
+	}
+
+	if n != math.Trunc(n) {
+		return 0, fmt.Errorf("Argument %d to '%s' must be a whole number.", i+1, fn)
+	}
+
+	return int(n), nil
+}
+
+func (vm *VM) clockNative([]Value) (Value, error) {
+	return ValueNumber(time.Now().Unix() - vm.startTime), nil
+}
+
+func lenNative(args []Value) (Value, error) {
+	switch v := args[0].(type) {
+	case ValueString:
+		return ValueNumber(utf8.RuneCountInString(string(v))), nil
+	case *ValueList:
+		return ValueNumber(len(v.items)), nil
+	case *ValueMap:
+		return ValueNumber(len(v.entries)), nil
+	}
+
+	return nil, fmt.Errorf("Argument 1 to 'len' must be a string, list or map.")
+}
+
+// substr(s, start) or substr(s, start, length)
+func (vm *VM) substrNative(args []Value) (Value, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, fmt.Errorf("Expected 2 or 3 arguments but got %d.", len(args))
+	}
+
+	s, err := stringArg("substr", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	runes := []rune(s)
+
+	start, err := intArg("substr", args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if start < 0 || start > len(runes) {
+		return nil, fmt.Errorf("Start index %d out of range for string of length %d.", start, len(runes))
+	}
+
+	end := len(runes)
+	if len(args) == 3 {
+		length, err := intArg("substr", args, 2)
+		if err != nil {
+			return nil, err
+		}
+
+		if length < 0 {
+			return nil, fmt.Errorf("Length can't be negative.")
+		}
+
+		if start+length < end {
+			end = start + length
+		}
+	}
+
+	return vm.newString(string(runes[start:end]))
+}
+
+func indexOfNative(args []Value) (Value, error) {
+	s, err := stringArg("indexOf", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	sub, err := stringArg("indexOf", args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	i := strings.Index(s, sub)
+	if i < 0 {
+		return ValueNumber(-1), nil
+	}
+
+	return ValueNumber(utf8.RuneCountInString(s[:i])), nil
+}
+
+func (vm *VM) upperNative(args []Value) (Value, error) {
+	s, err := stringArg("upper", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return vm.newString(strings.ToUpper(s))
+}
+
+func (vm *VM) lowerNative(args []Value) (Value, error) {
+	s, err := stringArg("lower", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return vm.newString(strings.ToLower(s))
+}
+
+func (vm *VM) trimNative(args []Value) (Value, error) {
+	s, err := stringArg("trim", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return vm.newString(strings.TrimSpace(s))
+}
+
+// newString charges a string that a native made against the memory limit.
+func (vm *VM) newString(s string) (Value, error) {
+	if err := vm.allocate(len(s)); err != nil {
+		return nil, err
+	}
+
+	return ValueString(s), nil
+}
+
+// split(s, sep) returns a list of the pieces of s between each sep; if sep is
+// empty, that's every character.
+func (vm *VM) splitNative(args []Value) (Value, error) {
+	s, err := stringArg("split", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	sep, err := stringArg("split", args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	pieces := strings.Split(s, sep)
+	if err := vm.allocate(sizeofList + len(pieces)*sizeofValue + len(s)); err != nil {
+		return nil, err
+	}
+
+	items := make([]Value, len(pieces))
+	for i, piece := range pieces {
+		items[i] = ValueString(piece)
+	}
+
+	return NewList(items), nil
+}
+
+// push(list, value) adds value to the end of list.
+func (vm *VM) pushNative(args []Value) (Value, error) {
+	list, err := listArg("push", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := vm.allocate(sizeofValue); err != nil {
+		return nil, err
+	}
+
+	list.items = append(list.items, args[1])
+	return ValueNil(0), nil
+}
+
+// pop(list) removes the last item from list and returns it.
+func popNative(args []Value) (Value, error) {
+	list, err := listArg("pop", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(list.items) == 0 {
+		return nil, fmt.Errorf("Can't pop from an empty list.")
+	}
+
+	last := list.items[len(list.items)-1]
+	list.items[len(list.items)-1] = nil
+	list.items = list.items[:len(list.items)-1]
+
+	return last, nil
+}
+
+// insert(list, index, value) puts value at index, moving everything after it
+// along by one.
+func (vm *VM) insertNative(args []Value) (Value, error) {
+	list, err := listArg("insert", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := listIndex(list, args[1], true)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := vm.allocate(sizeofValue); err != nil {
+		return nil, err
+	}
+
+	list.items = append(list.items, nil)
+	copy(list.items[i+1:], list.items[i:])
+	list.items[i] = args[2]
+
+	return ValueNil(0), nil
+}
+
+// remove(list, index) removes the item at index and returns it.
+func removeNative(args []Value) (Value, error) {
+	list, err := listArg("remove", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := listIndex(list, args[1], false)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := list.items[i]
+	copy(list.items[i:], list.items[i+1:])
+	list.items[len(list.items)-1] = nil
+	list.items = list.items[:len(list.items)-1]
+
+	return removed, nil
+}
+
+// has(map, key) reports whether key is in map.
+func hasNative(args []Value) (Value, error) {
+	m, err := mapArg("has", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	_, ok := m.get(args[1])
+	return ValueBool(ok), nil
+}
+
+// keys(map) returns a list of the keys in map, in insertion order.
+func (vm *VM) keysNative(args []Value) (Value, error) {
+	m, err := mapArg("keys", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := vm.allocate(sizeofList + len(m.entries)*sizeofValue); err != nil {
+		return nil, err
+	}
+
+	items := make([]Value, len(m.entries))
+	for i, entry := range m.entries {
+		items[i] = entry.key
+	}
+
+	return NewList(items), nil
+}
+
+// values(map) returns a list of the values in map, in insertion order.
+func (vm *VM) valuesNative(args []Value) (Value, error) {
+	m, err := mapArg("values", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := vm.allocate(sizeofList + len(m.entries)*sizeofValue); err != nil {
+		return nil, err
+	}
+
+	items := make([]Value, len(m.entries))
+	for i, entry := range m.entries {
+		items[i] = entry.value
+	}
+
+	return NewList(items), nil
+}
+
+// delete(map, key) removes key from map, and returns whether it was there.
+func deleteNative(args []Value) (Value, error) {
+	m, err := mapArg("delete", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return ValueBool(m.delete(args[1])), nil
+}
+
+// mathNative wraps a one-argument function from the math package.
+func mathNative(name string, fn func(float64) float64) NativeFn {
+	return func(args []Value) (Value, error) {
+		n, err := numberArg(name, args, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		return ValueNumber(fn(n)), nil
+	}
+}
+
+func powNative(args []Value) (Value, error) {
+	x, err := numberArg("pow", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	y, err := numberArg("pow", args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return ValueNumber(math.Pow(x, y)), nil
+}
+
+// extremeNative is min or max, which take one or more numbers.
+func extremeNative(name string, pick func(float64, float64) float64) NativeFn {
+	return func(args []Value) (Value, error) {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("'%s' needs at least one argument.", name)
+		}
+
+		result, err := numberArg(name, args, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := 1; i < len(args); i++ {
+			n, err := numberArg(name, args, i)
+			if err != nil {
+				return nil, err
+			}
+
+			result = pick(result, n)
+		}
+
+		return ValueNumber(result), nil
+	}
+}
+
+// random() returns a number in [0, 1)
+func (vm *VM) randomNative([]Value) (Value, error) {
+	return ValueNumber(vm.rng.Float64()), nil
+}
+
+func (vm *VM) strNative(args []Value) (Value, error) {
+	if s, ok := args[0].(ValueString); ok {
+		return s, nil
+	}
+
+	var b strings.Builder
+	FprintValue(&b, args[0])
+	return vm.newString(b.String())
+}
+
+// num converts a string to a number, or returns nil if it doesn't look like
+// one.
+func numNative(args []Value) (Value, error) {
+	switch v := args[0].(type) {
+	case ValueNumber:
+		return v, nil
+	case ValueString:
+		n, err := strconv.ParseFloat(strings.TrimSpace(string(v)), 64)
+		if err != nil {
+			return ValueNil(0), nil
+		}
+
+		return ValueNumber(n), nil
+	}
+
+	return nil, fmt.Errorf("Can only convert strings to numbers.")
+}
+
+func typeNative(args []Value) (Value, error) {
+	var name string
+
+	switch args[0].(type) {
+	case ValueNil:
+		name = "nil"
+	case ValueBool:
+		name = "bool"
+	case ValueNumber:
+		name = "number"
+	case ValueString:
+		name = "string"
+	case ValueFunction, *ValueClosure, *ValueBoundMethod, ValueNative:
+		name = "function"
+	case *ValueClass:
+		name = "class"
+	case *ValueInstance:
+		name = "instance"
+	case *ValueList:
+		name = "list"
+	case *ValueMap:
+		name = "map"
+	case ValueRange:
+		name = "range"
+	default:
+		name = "unknown"
+	}
+
+	return ValueString(name), nil
+}
+
+// input() reads a line, without the newline, or returns nil at end of input.
+func (vm *VM) inputNative([]Value) (Value, error) {
+	line, err := vm.stdin.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return ValueNil(0), nil
+	} else if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+
+	return ValueString(line), nil
+}
@@ -1,6 +1,10 @@
 package lox
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"os"
+)
 
 // this all feels fairly kludgey to me...
 type Value interface {
@@ -14,40 +18,177 @@ type ValueNumber float64
 type ValueString string
 
 type ValueFunction struct {
-	arity int
-	chunk *Chunk
-	name  string
+	arity        int
+	upvalueCount int
+	chunk        *Chunk
+	name         string
 }
 
-type NativeFn func(argCount int, args []Value) Value
+type ValueClosure struct {
+	function *ValueFunction
+	upvalues []*ValueUpvalue
+}
+
+// ValueUpvalue isn't really a value you can get your hands on from Lox, but
+// it lives on the heap like one. While it's open, location points into the
+// VM stack; once closed, it points at its own closed field.
+type ValueUpvalue struct {
+	location *Value
+	closed   Value
+	slot     int
+	next     *ValueUpvalue
+}
+
+type ValueClass struct {
+	name    string
+	methods map[string]Value
+}
+
+type ValueInstance struct {
+	class  *ValueClass
+	fields map[string]Value
+}
+
+type ValueList struct {
+	items []Value
+}
+
+// ValueMap keeps its entries in insertion order; index maps each key to its
+// position in entries. Only hashable values can be keys (see hashable).
+type ValueMap struct {
+	entries []mapEntry
+	index   map[Value]int
+}
+
+type mapEntry struct {
+	key   Value
+	value Value
+}
+
+type ValueBoundMethod struct {
+	receiver Value
+	method   *ValueClosure
+}
+
+// NativeFn is a Go function callable from Lox. An error becomes a Lox runtime
+// error, with the error's text as the message. The args slice points into the
+// VM's stack, so it's only valid until the function returns.
+type NativeFn func(args []Value) (Value, error)
+
+// VARIADIC is the arity of a native that takes any number of arguments.
+const VARIADIC = -1
 
 type ValueNative struct {
+	name     string
+	arity    int
 	function NativeFn
 }
 
 func PrintValue(v Value) {
+	FprintValue(os.Stdout, v)
+}
+
+// FprintValue writes the printed representation of a value to w
+func FprintValue(w io.Writer, v Value) {
+	printValue(w, v, nil)
+}
+
+// printValue does the work for FprintValue. Lists and maps can contain
+// themselves, so we keep track of the ones we're in the middle of printing.
+func printValue(w io.Writer, v Value, printing []Value) {
 	switch v.(type) {
 	case ValueBool:
 		val := v.(ValueBool)
-		fmt.Printf("%v", val)
+		fmt.Fprintf(w, "%v", val)
 	case ValueNumber:
-		fmt.Printf("%g", v)
+		fmt.Fprintf(w, "%g", v)
 	case ValueNil:
-		fmt.Printf("nil")
+		fmt.Fprintf(w, "nil")
 	case ValueString:
-		fmt.Print(v)
+		fmt.Fprint(w, v)
 	case ValueFunction:
 		function := v.(ValueFunction)
-		name := function.name
-		if name == "" {
-			name = "<script>"
-		}
-		fmt.Printf("<fn %s>", name)
+		printFunction(w, &function)
+	case *ValueClosure:
+		printFunction(w, v.(*ValueClosure).function)
 	case ValueNative:
-		fmt.Printf("<native fn>")
+		fmt.Fprintf(w, "<native fn %s>", v.(ValueNative).name)
+	case *ValueClass:
+		fmt.Fprintf(w, "%s", v.(*ValueClass).name)
+	case *ValueInstance:
+		fmt.Fprintf(w, "%s instance", v.(*ValueInstance).class.name)
+	case *ValueBoundMethod:
+		printFunction(w, v.(*ValueBoundMethod).method.function)
+	case *ValueList:
+		printList(w, v.(*ValueList), printing)
+	case *ValueMap:
+		printMap(w, v.(*ValueMap), printing)
+	case ValueRange:
+		r := v.(ValueRange)
+		fmt.Fprintf(w, "range(%g, %g, %g)", r.start, r.end, r.step)
+	case *valueIterator:
+		fmt.Fprint(w, "<iterator>")
 	default:
-		fmt.Printf("wat? %T", v)
+		fmt.Fprintf(w, "wat? %T", v)
+	}
+}
+
+func printFunction(w io.Writer, function *ValueFunction) {
+	name := function.name
+	if name == "" {
+		name = "<script>"
+	}
+	fmt.Fprintf(w, "<fn %s>", name)
+}
+
+func printList(w io.Writer, list *ValueList, printing []Value) {
+	if isOneOf(list, printing) {
+		fmt.Fprint(w, "[...]")
+		return
+	}
+
+	printing = append(printing, list)
+
+	fmt.Fprint(w, "[")
+	for i, item := range list.items {
+		if i > 0 {
+			fmt.Fprint(w, ", ")
+		}
+		printValue(w, item, printing)
+	}
+	fmt.Fprint(w, "]")
+}
+
+func printMap(w io.Writer, m *ValueMap, printing []Value) {
+	if isOneOf(m, printing) {
+		fmt.Fprint(w, "{...}")
+		return
+	}
+
+	printing = append(printing, m)
+
+	fmt.Fprint(w, "{")
+	for i, entry := range m.entries {
+		if i > 0 {
+			fmt.Fprint(w, ", ")
+		}
+		printValue(w, entry.key, printing)
+		fmt.Fprint(w, ": ")
+		printValue(w, entry.value, printing)
+	}
+	fmt.Fprint(w, "}")
+}
+
+// isOneOf reports whether v is exactly one of values (the same object, for
+// lists and maps, not just an equal one).
+func isOneOf(v Value, values []Value) bool {
+	for _, seen := range values {
+		if seen == v {
+			return true
+		}
 	}
+
+	return false
 }
 
 func IsFalsy(v Value) bool {
@@ -77,6 +218,43 @@ func NewFunction() *ValueFunction {
 	}
 }
 
+func NewClosure(function *ValueFunction) *ValueClosure {
+	return &ValueClosure{
+		function: function,
+		upvalues: make([]*ValueUpvalue, function.upvalueCount),
+	}
+}
+
+func NewUpvalue(slot *Value, index int) *ValueUpvalue {
+	return &ValueUpvalue{location: slot, slot: index}
+}
+
+func NewClass(name string) *ValueClass {
+	return &ValueClass{
+		name:    name,
+		methods: make(map[string]Value),
+	}
+}
+
+func NewInstance(class *ValueClass) *ValueInstance {
+	return &ValueInstance{
+		class:  class,
+		fields: make(map[string]Value),
+	}
+}
+
+func NewList(items []Value) *ValueList {
+	return &ValueList{items: items}
+}
+
+func NewMap() *ValueMap {
+	return &ValueMap{index: make(map[Value]int)}
+}
+
+func NewBoundMethod(receiver Value, method *ValueClosure) *ValueBoundMethod {
+	return &ValueBoundMethod{receiver: receiver, method: method}
+}
+
 func (v ValueBool) Equals(other Value) bool {
 	x, isBool := other.(ValueBool)
 	return isBool && v == x
@@ -104,3 +282,33 @@ func (v ValueFunction) Equals(other Value) bool {
 func (v ValueNative) Equals(other Value) bool {
 	return false
 }
+
+func (v *ValueClosure) Equals(other Value) bool {
+	x, isClosure := other.(*ValueClosure)
+	return isClosure && v == x
+}
+
+func (v *ValueClass) Equals(other Value) bool {
+	x, isClass := other.(*ValueClass)
+	return isClass && v == x
+}
+
+func (v *ValueInstance) Equals(other Value) bool {
+	x, isInstance := other.(*ValueInstance)
+	return isInstance && v == x
+}
+
+func (v *ValueList) Equals(other Value) bool {
+	x, isList := other.(*ValueList)
+	return isList && v == x
+}
+
+func (v *ValueMap) Equals(other Value) bool {
+	x, isMap := other.(*ValueMap)
+	return isMap && v == x
+}
+
+func (v *ValueBoundMethod) Equals(other Value) bool {
+	x, isBound := other.(*ValueBoundMethod)
+	return isBound && v == x
+}
@@ -0,0 +1,458 @@
+package lox
+
+import (
+	"fmt"
+	"strings"
+)
+
+// VerifyError collects everything wrong with a function (and the functions
+// nested in it), so you can see all of it at once.
+type VerifyError struct {
+	Problems []VerifyProblem
+}
+
+type VerifyProblem struct {
+	Function string
+	Offset   int
+	Line     int
+	Message  string
+}
+
+// verifier checks one function's chunk
+type verifier struct {
+	function   *ValueFunction
+	chunk      *Chunk
+	problems   []VerifyProblem
+	boundaries map[int]bool
+	jumps      map[int]int // instruction offset -> jump target
+}
+
+// Verify walks a compiled function and everything nested inside it, checking
+// that the VM can run it without tripping over a bad operand: opcodes are
+// known, constant and slot indices are in bounds, jumps land on instruction
+// boundaries, and the stack depth at every instruction is consistent no
+// matter how we got there. Compile always produces valid code; this is for
+// bytecode that came from somewhere else.
+func Verify(function ValueFunction) error {
+	problems := verifyFunction(&function)
+
+	if function.arity != 0 || function.upvalueCount != 0 {
+		problems = append(problems, VerifyProblem{
+			Function: "<script>",
+			Message:  "top-level function can't take arguments or capture upvalues",
+		})
+	}
+	if len(problems) > 0 {
+		return &VerifyError{Problems: problems}
+	}
+
+	return nil
+}
+
+func (e *VerifyError) Error() string {
+	var b strings.Builder
+	b.WriteString("bytecode verification failed:")
+
+	for _, p := range e.Problems {
+		b.WriteString("\n  ")
+		b.WriteString(p.String())
+	}
+
+	return b.String()
+}
+
+func (e *VerifyError) Is(target error) bool {
+	return target == ErrBadBytecode
+}
+
+func (p VerifyProblem) String() string {
+	return fmt.Sprintf("%s: offset %04d [line %d]: %s", p.Function, p.Offset, p.Line, p.Message)
+}
+
+func verifyFunction(function *ValueFunction) []VerifyProblem {
+	v := &verifier{
+		function:   function,
+		chunk:      function.chunk,
+		boundaries: make(map[int]bool),
+		jumps:      make(map[int]int),
+	}
+
+	if v.decode() {
+		v.checkJumps()
+		v.checkStack()
+	}
+
+	for _, constant := range *v.chunk.constants {
+		if nested, ok := constant.(ValueFunction); ok {
+			v.problems = append(v.problems, verifyFunction(&nested)...)
+		}
+	}
+
+	return v.problems
+}
+
+func (v *verifier) errorAt(offset int, format string, args ...any) {
+	name := v.function.name
+	if name == "" {
+		name = "<script>"
+	}
+
+	v.problems = append(v.problems, VerifyProblem{
+		Function: name,
+		Offset:   offset,
+		Line:     v.lineFor(offset),
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// lineFor is like GetLine, but won't panic on a bogus line table
+func (v *verifier) lineFor(offset int) int {
+	l := v.chunk.lines
+	if len(l) < 2 || l[len(l)-1] < offset {
+		return 0
+	}
+
+	return v.chunk.GetLine(offset)
+}
+
+// decode makes a linear pass over the code, checking each instruction's
+// operands, and returns false if the code is too broken to analyze further.
+func (v *verifier) decode() bool {
+	code := v.chunk.code
+	ok := true
+
+	if len(code) == 0 {
+		v.errorAt(0, "empty chunk")
+		return false
+	}
+
+	for offset := 0; offset < len(code); {
+		v.boundaries[offset] = true
+		op := OpCode(code[offset])
+
+		if op.String() == "" {
+			v.errorAt(offset, "unknown opcode %d", code[offset])
+			return false
+		}
+
+		length := instructionLength(v.chunk, offset)
+		if length < 0 || offset+length > len(code) {
+			v.errorAt(offset, "%s: operands run past end of code", op)
+			return false
+		}
+
+		if !v.checkOperands(op, offset) {
+			ok = false
+		}
+
+		offset += length
+	}
+
+	return ok
+}
+
+func (v *verifier) checkOperands(op OpCode, offset int) bool {
+	code := v.chunk.code
+	before := len(v.problems)
+
+	switch op {
+	case OP_CONSTANT, OP_CONSTANT_LONG:
+		v.constantOperand(op, offset, false)
+
+	case OP_DEFINE_GLOBAL, OP_GET_GLOBAL, OP_SET_GLOBAL,
+		OP_DEFINE_GLOBAL_LONG, OP_GET_GLOBAL_LONG, OP_SET_GLOBAL_LONG,
+		OP_GET_PROPERTY, OP_SET_PROPERTY, OP_GET_SUPER,
+		OP_INVOKE, OP_SUPER_INVOKE, OP_CLASS, OP_METHOD,
+		OP_GET_PROPERTY_LONG, OP_SET_PROPERTY_LONG, OP_GET_SUPER_LONG,
+		OP_INVOKE_LONG, OP_SUPER_INVOKE_LONG, OP_CLASS_LONG, OP_METHOD_LONG:
+		v.constantOperand(op, offset, true)
+
+	case OP_GET_UPVALUE, OP_SET_UPVALUE:
+		if index := int(code[offset+1]); index >= v.function.upvalueCount {
+			v.errorAt(offset, "%s: upvalue %d out of range (have %d)",
+				op, index, v.function.upvalueCount)
+		}
+
+	case OP_JUMP, OP_JUMP_IF_FALSE, OP_JUMP_IF_TRUE, OP_ITER_NEXT:
+		v.jumps[offset] = offset + 3 + readShortAt(code, offset+1)
+
+	case OP_LOOP:
+		v.jumps[offset] = offset + 3 - readShortAt(code, offset+1)
+
+	case OP_CLOSURE, OP_CLOSURE_LONG:
+		constant := v.constantOperand(op, offset, false)
+		function, isFunction := constant.(ValueFunction)
+		if constant != nil && !isFunction {
+			v.errorAt(offset, "%s: constant is not a function", op)
+		}
+
+		if !isFunction {
+			break
+		}
+
+		pairs := offset + 2
+		if op == OP_CLOSURE_LONG {
+			pairs = offset + 4
+		}
+
+		for i := 0; i < function.upvalueCount; i++ {
+			isLocal, index := code[pairs+2*i], int(code[pairs+2*i+1])
+
+			if isLocal > 1 {
+				v.errorAt(offset, "%s: bad upvalue flag %d", op, isLocal)
+			} else if isLocal == 0 && index >= v.function.upvalueCount {
+				// captured from our own upvalues, not the stack
+				v.errorAt(offset, "%s: captured upvalue %d out of range (have %d)",
+					op, index, v.function.upvalueCount)
+			}
+		}
+	}
+
+	return len(v.problems) == before
+}
+
+// constantOperand checks that the constant an instruction refers to exists
+// (and is a string, for instructions that look things up by name), and
+// returns it if so.
+func (v *verifier) constantOperand(op OpCode, offset int, wantString bool) Value {
+	index := constantIndexAt(v.chunk, offset)
+	constants := *v.chunk.constants
+
+	if index >= len(constants) {
+		v.errorAt(offset, "%s: constant %d out of range (have %d)", op, index, len(constants))
+		return nil
+	}
+
+	if _, isString := constants[index].(ValueString); wantString && !isString {
+		v.errorAt(offset, "%s: constant %d is not a name", op, index)
+		return nil
+	}
+
+	return constants[index]
+}
+
+func (v *verifier) checkJumps() {
+	for offset, target := range v.jumps {
+		if !v.boundaries[target] {
+			v.errorAt(offset, "%s: target %d is not an instruction boundary",
+				OpCode(v.chunk.code[offset]), target)
+		}
+	}
+}
+
+// checkStack follows every path through the code, tracking how deep the
+// stack is relative to the frame's base.
+func (v *verifier) checkStack() {
+	code := v.chunk.code
+	depths := make(map[int]int)
+
+	// slot zero plus the parameters
+	work := []int{0}
+	depths[0] = v.function.arity + 1
+
+	for len(work) > 0 {
+		offset := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		op := OpCode(code[offset])
+		depth := depths[offset]
+		pops, pushes := stackEffect(v.chunk, offset)
+
+		// slot zero always has to stay put
+		if depth-pops < 1 {
+			v.errorAt(offset, "%s: stack underflow (depth %d, pops %d)", op, depth, pops)
+			continue
+		}
+
+		switch op {
+		case OP_GET_LOCAL, OP_SET_LOCAL:
+			if slot := int(code[offset+1]); slot >= depth {
+				v.errorAt(offset, "%s: local slot %d out of range (depth %d)", op, slot, depth)
+			}
+
+		case OP_CLOSURE, OP_CLOSURE_LONG:
+			v.checkCaptures(offset, depth)
+		}
+
+		after := depth - pops + pushes
+		successors := make([]int, 0, 2)
+
+		switch op {
+		case OP_RETURN:
+			// no successors
+		case OP_JUMP, OP_LOOP:
+			successors = append(successors, v.jumps[offset])
+		case OP_JUMP_IF_FALSE, OP_JUMP_IF_TRUE, OP_ITER_NEXT:
+			successors = append(successors, offset+3, v.jumps[offset])
+		default:
+			successors = append(successors, offset+instructionLength(v.chunk, offset))
+		}
+
+		for _, next := range successors {
+			if next >= len(code) {
+				v.errorAt(offset, "%s: execution runs off the end of the code", op)
+				continue
+			}
+
+			if !v.boundaries[next] {
+				continue // already reported by checkJumps
+			}
+
+			if seen, ok := depths[next]; ok {
+				if seen != after {
+					v.errorAt(next, "inconsistent stack depth (%d vs %d)", seen, after)
+				}
+				continue
+			}
+
+			depths[next] = after
+			work = append(work, next)
+		}
+	}
+}
+
+func (v *verifier) checkCaptures(offset, depth int) {
+	code := v.chunk.code
+	function, ok := (*v.chunk.constants)[constantIndexAt(v.chunk, offset)].(ValueFunction)
+	if !ok {
+		return
+	}
+
+	pairs := offset + 2
+	if OpCode(code[offset]) == OP_CLOSURE_LONG {
+		pairs = offset + 4
+	}
+
+	for i := 0; i < function.upvalueCount; i++ {
+		isLocal, index := code[pairs+2*i], int(code[pairs+2*i+1])
+		if isLocal == 1 && index >= depth {
+			v.errorAt(offset, "%s: captured local %d out of range (depth %d)",
+				OpCode(code[offset]), index, depth)
+		}
+	}
+}
+
+// helpers shared with anything else that needs to walk instructions
+
+// instructionLength returns the length of the instruction at offset,
+// including its operands, or -1 if the operands run off the end.
+func instructionLength(chunk *Chunk, offset int) int {
+	code := chunk.code
+
+	switch OpCode(code[offset]) {
+	case OP_CONSTANT, OP_DEFINE_GLOBAL, OP_GET_GLOBAL, OP_SET_GLOBAL,
+		OP_GET_LOCAL, OP_SET_LOCAL, OP_GET_UPVALUE, OP_SET_UPVALUE,
+		OP_GET_PROPERTY, OP_SET_PROPERTY, OP_GET_SUPER,
+		OP_CALL, OP_CLASS, OP_METHOD, OP_BUILD_LIST, OP_BUILD_MAP:
+		return 2
+
+	case OP_JUMP, OP_JUMP_IF_FALSE, OP_JUMP_IF_TRUE, OP_LOOP,
+		OP_INVOKE, OP_SUPER_INVOKE, OP_ITER_NEXT:
+		return 3
+
+	case OP_CONSTANT_LONG, OP_DEFINE_GLOBAL_LONG, OP_GET_GLOBAL_LONG, OP_SET_GLOBAL_LONG,
+		OP_GET_PROPERTY_LONG, OP_SET_PROPERTY_LONG, OP_GET_SUPER_LONG,
+		OP_CLASS_LONG, OP_METHOD_LONG:
+		return 4
+
+	case OP_INVOKE_LONG, OP_SUPER_INVOKE_LONG:
+		return 5
+
+	case OP_CLOSURE, OP_CLOSURE_LONG:
+		length := 2
+		if OpCode(code[offset]) == OP_CLOSURE_LONG {
+			length = 4
+		}
+
+		if offset+length > len(code) {
+			return -1
+		}
+
+		index := constantIndexAt(chunk, offset)
+		if index < len(*chunk.constants) {
+			if function, ok := (*chunk.constants)[index].(ValueFunction); ok {
+				length += 2 * function.upvalueCount
+			}
+		}
+
+		return length
+
+	default:
+		return 1
+	}
+}
+
+// constantIndexAt returns the constant operand for the instruction at offset,
+// whether it's a one-byte or a three-byte one.
+func constantIndexAt(chunk *Chunk, offset int) int {
+	code := chunk.code
+
+	switch OpCode(code[offset]) {
+	case OP_CONSTANT_LONG, OP_DEFINE_GLOBAL_LONG, OP_GET_GLOBAL_LONG,
+		OP_SET_GLOBAL_LONG, OP_CLOSURE_LONG, OP_GET_PROPERTY_LONG,
+		OP_SET_PROPERTY_LONG, OP_GET_SUPER_LONG, OP_INVOKE_LONG,
+		OP_SUPER_INVOKE_LONG, OP_CLASS_LONG, OP_METHOD_LONG:
+		return int(code[offset+1])<<16 | int(code[offset+2])<<8 | int(code[offset+3])
+	default:
+		return int(code[offset+1])
+	}
+}
+
+func readShortAt(code []byte, offset int) int {
+	return int(code[offset])<<8 | int(code[offset+1])
+}
+
+// stackEffect returns how many values the instruction at offset pops and
+// pushes. (Ops that just peek count as popping and pushing the same value.)
+func stackEffect(chunk *Chunk, offset int) (int, int) {
+	code := chunk.code
+
+	switch OpCode(code[offset]) {
+	case OP_CONSTANT, OP_CONSTANT_LONG, OP_NIL, OP_TRUE, OP_FALSE,
+		OP_GET_GLOBAL, OP_GET_GLOBAL_LONG, OP_GET_LOCAL, OP_GET_UPVALUE,
+		OP_CLOSURE, OP_CLOSURE_LONG, OP_CLASS, OP_CLASS_LONG, OP_ITER_NEXT:
+		return 0, 1
+
+	case OP_POP, OP_DEFINE_GLOBAL, OP_DEFINE_GLOBAL_LONG, OP_PRINT,
+		OP_CLOSE_UPVALUE, OP_RETURN:
+		return 1, 0
+
+	case OP_SET_GLOBAL, OP_SET_GLOBAL_LONG, OP_SET_LOCAL, OP_SET_UPVALUE,
+		OP_GET_PROPERTY, OP_GET_PROPERTY_LONG, OP_NOT, OP_NEGATE,
+		OP_JUMP_IF_FALSE, OP_JUMP_IF_TRUE, OP_ITER:
+		return 1, 1
+
+	case OP_SET_PROPERTY, OP_SET_PROPERTY_LONG, OP_GET_SUPER, OP_GET_SUPER_LONG,
+		OP_EQUAL, OP_GREATER, OP_LESS, OP_ADD, OP_SUBTRACT, OP_MULTIPLY,
+		OP_DIVIDE, OP_INHERIT, OP_METHOD, OP_METHOD_LONG, OP_INDEX_GET:
+		return 2, 1
+
+	case OP_INDEX_SET:
+		return 3, 1
+
+	case OP_BUILD_LIST:
+		return int(code[offset+1]), 1
+
+	case OP_BUILD_MAP:
+		return 2 * int(code[offset+1]), 1
+
+	case OP_CALL:
+		return int(code[offset+1]) + 1, 1
+
+	case OP_INVOKE:
+		return int(code[offset+2]) + 1, 1
+
+	case OP_INVOKE_LONG:
+		return int(code[offset+4]) + 1, 1
+
+	case OP_SUPER_INVOKE:
+		// the receiver and arguments, plus the superclass on top
+		return int(code[offset+2]) + 2, 1
+
+	case OP_SUPER_INVOKE_LONG:
+		return int(code[offset+4]) + 2, 1
+
+	default:
+		return 0, 0
+	}
+}
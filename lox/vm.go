@@ -1,89 +1,173 @@
 package lox
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/mmcclimon/glox/lox/op"
 )
 
-const FRAMES_MAX = 64
-const STACK_MAX = FRAMES_MAX * UINT8_COUNT
-
-var InterpretCompileError = errors.New("compile error")
-var InterpretRuntimeError = errors.New("runtime error")
-var vmStartTime int64
+// FRAMES_MAX is the default limit on call depth; see SetMaxFrames. The stack
+// and frames start out small and grow as needed, up to that limit.
+const FRAMES_MAX = 1024
+const FRAMES_INITIAL = 16
+const STACK_INITIAL = UINT8_COUNT
 
 type CallFrame struct {
-	function *ValueFunction
-	ip       int
-	slots    []Value
-	sp       int // this is the stack pointer where we _start_
+	closure *ValueClosure
+	ip      int
+	slots   []Value
+	sp      int // this is the stack pointer where we _start_
 }
 
 type VM struct {
-	frames     [FRAMES_MAX]CallFrame
-	frameCount int
-	stack      [STACK_MAX]Value
-	sp         int
-	globals    map[string]Value
-}
-
-func init() {
-	vmStartTime = time.Now().Unix()
+	frames       []CallFrame
+	frameCount   int
+	maxFrames    int
+	stack        []Value
+	sp           int
+	globals      map[string]Value
+	openUpvalues *ValueUpvalue
+	stdout       io.Writer
+	stderr       io.Writer
+	stdin        *bufio.Reader
+	debug        DebugFlags
+	startTime    int64
+	rng          *rand.Rand
+
+	ctx              context.Context
+	instructionLimit int
+	instructionCount int
+	memoryLimit      int
+	bytesAllocated   int
 }
 
+// NewVM returns a VM with nothing but the built-in globals defined. A VM must
+// only be used from one goroutine at a time, but any number of VMs can run
+// at once, including ones running the same compiled function.
 func NewVM() *VM {
-	vm := VM{
-		globals: make(map[string]Value),
+	vm := &VM{
+		frames:    make([]CallFrame, FRAMES_INITIAL),
+		maxFrames: FRAMES_MAX,
+		stack:     make([]Value, STACK_INITIAL),
+		globals:   make(map[string]Value),
+		stdin:     bufio.NewReader(os.Stdin),
+		stdout:    os.Stdout,
+		stderr:    os.Stderr,
+		startTime: time.Now().Unix(),
+		rng:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		ctx:       context.Background(),
 	}
 
-	vm.defineNative("clock", clockNative)
+	vm.defineStdlib()
+
+	return vm
+}
+
+// Run runs an already-compiled function in a fresh VM, writing its output to
+// stdout and any errors to stderr.
+func Run(function ValueFunction, stdout, stderr io.Writer) error {
+	vm := NewVM()
+	vm.SetStdout(stdout)
+	vm.SetStderr(stderr)
+
+	return vm.Interpret(function)
+}
+
+// SetStdout sets where the VM writes program output, like from print
+func (vm *VM) SetStdout(w io.Writer) {
+	vm.stdout = w
+}
+
+// SetStderr sets where the VM writes compile and runtime error messages
+func (vm *VM) SetStderr(w io.Writer) {
+	vm.stderr = w
+}
+
+// SetMaxFrames sets how deep calls can go before the VM gives up with a
+// stack overflow error.
+func (vm *VM) SetMaxFrames(max int) {
+	vm.maxFrames = max
+}
 
-	return &vm
+// SetDebug turns debugging output on or off for this VM.
+func (vm *VM) SetDebug(flags DebugFlags) {
+	vm.debug = flags
 }
 
 func (vm *VM) InterpretString(source string) error {
-	function, err := Compile(source)
+	var codeOut io.Writer
+	if vm.debug.PrintCode {
+		codeOut = vm.stdout
+	}
+
+	function, err := compile(source, vm.stderr, codeOut)
 
 	if err != nil {
-		return InterpretCompileError
+		return err
 	}
 
-	vm.push(function)
-	vm.call(&function, 0)
-
-	return vm.run()
+	return vm.Interpret(function)
 }
 
-func (vm *VM) resetStack() {
-	vm.frameCount = 0
-	vm.sp = 0
+// Interpret runs an already-compiled top-level function, like one that
+// Compile returns or that was loaded with ReadBytecode. Functions are never
+// modified once compiled, so the same one can be run by many VMs at once.
+func (vm *VM) Interpret(function ValueFunction) error {
+	sp, frameCount := vm.sp, vm.frameCount
+
+	closure := NewClosure(&function)
+	vm.push(closure)
+	if err := vm.call(closure, 0); err != nil {
+		vm.unwind(sp, frameCount)
+		return err
+	}
+
+	if err := vm.run(frameCount); err != nil {
+		vm.unwind(sp, frameCount)
+		return err
+	}
+
+	vm.pop() // the script's return value
+	return nil
 }
 
-/*
-func (vm *VM) Interpret(chunk *Chunk) error {
-	vm.chunk = chunk
-	vm.ip = 0
-	return vm.run()
+// unwind throws away the frames and stack slots above the given depths after
+// an error, closing any upvalues that point into them. Whatever started
+// running Lox code does this, so that an error in a call made from a native
+// only unwinds that call, and the code that called the native can carry on.
+func (vm *VM) unwind(sp, frameCount int) {
+	vm.closeUpvalues(sp)
+	vm.sp = sp
+	vm.frameCount = frameCount
 }
-*/
 
-func (vm *VM) run() error {
+// run executes until the frame count drops back to base, leaving the return
+// value of the last frame on the stack.
+func (vm *VM) run(base int) error {
 	frame := vm.currentFrame()
 
 	for {
-		if DEBUG_TRACE_EXECUTION {
-			frame.function.chunk.DisassembleInstruction(frame.ip)
-			fmt.Printf("          ")
+		if err := vm.checkLimits(); err != nil {
+			return err
+		}
+
+		if vm.debug.TraceExecution {
+			frame.closure.function.chunk.DisassembleInstruction(vm.stdout, frame.ip)
+			fmt.Fprintf(vm.stdout, "          ")
 			for i := 0; i < vm.sp; i++ {
-				fmt.Printf("[ ")
-				PrintValue(vm.stack[i])
-				fmt.Printf(" ]")
+				fmt.Fprintf(vm.stdout, "[ ")
+				FprintValue(vm.stdout, vm.stack[i])
+				fmt.Fprintf(vm.stdout, " ]")
 			}
-			fmt.Printf("\n")
+			fmt.Fprintf(vm.stdout, "\n")
 		}
 
 		instruction := vm.readByte()
@@ -93,6 +177,10 @@ func (vm *VM) run() error {
 			constant := vm.readConstant()
 			vm.push(constant)
 
+		case OP_CONSTANT_LONG:
+			constant := vm.readConstantLong()
+			vm.push(constant)
+
 		case OP_ADD:
 			_, aIsStr := vm.peek(0).(ValueString)
 			_, bIsStr := vm.peek(1).(ValueString)
@@ -101,7 +189,9 @@ func (vm *VM) run() error {
 			_, bIsNum := vm.peek(1).(ValueNumber)
 
 			if aIsStr && bIsStr {
-				vm.concatenate()
+				if err := vm.concatenate(); err != nil {
+					return err
+				}
 			} else if aIsNum && bIsNum {
 				if err := vm.binaryOp(op.Plus); err != nil {
 					return err
@@ -163,21 +253,128 @@ func (vm *VM) run() error {
 			slot := vm.readByte()
 			frame.slots[slot] = vm.peek(0)
 
-		case OP_DEFINE_GLOBAL:
-			name := vm.readConstant().(ValueString)
+		case OP_GET_UPVALUE:
+			slot := vm.readByte()
+			vm.push(*frame.closure.upvalues[slot].location)
+
+		case OP_SET_UPVALUE:
+			slot := vm.readByte()
+			*frame.closure.upvalues[slot].location = vm.peek(0)
+
+		case OP_BUILD_LIST:
+			count := int(vm.readByte())
+			if err := vm.allocate(sizeofList + count*sizeofValue); err != nil {
+				return err
+			}
+
+			items := make([]Value, count)
+			copy(items, vm.stack[vm.sp-count:vm.sp])
+			vm.sp -= count
+			vm.push(NewList(items))
+
+		case OP_BUILD_MAP:
+			if err := vm.buildMap(int(vm.readByte())); err != nil {
+				return err
+			}
+
+		case OP_ITER:
+			iterable, ok := vm.peek(0).(Iterable)
+			if !ok {
+				return vm.RuntimeError("Can only iterate over strings, lists, maps and ranges.")
+			}
+
+			if err := vm.allocate(sizeofIterator); err != nil {
+				return err
+			}
+
+			vm.stack[vm.sp-1] = &valueIterator{iterable.Iterator()}
+
+		case OP_ITER_NEXT:
+			offset := vm.readShort()
+			iterator, ok := vm.peek(0).(*valueIterator)
+			if !ok {
+				return vm.RuntimeError("Expected an iterator.")
+			}
+
+			if value, ok := iterator.Next(); ok {
+				vm.push(value)
+			} else {
+				vm.push(ValueNil(0))
+				frame.ip += offset
+			}
+
+		case OP_INDEX_GET:
+			if err := vm.indexGet(); err != nil {
+				return err
+			}
+
+		case OP_INDEX_SET:
+			if err := vm.indexSet(); err != nil {
+				return err
+			}
+
+		case OP_GET_PROPERTY, OP_GET_PROPERTY_LONG:
+			instance, isInstance := vm.peek(0).(*ValueInstance)
+			if !isInstance {
+				return vm.RuntimeError("Only instances have properties.")
+			}
+
+			name := string(vm.readConstantFor(OpCode(instruction)).(ValueString))
+			if value, ok := instance.fields[name]; ok {
+				vm.pop() // instance
+				vm.push(value)
+				break
+			}
+
+			if err := vm.bindMethod(instance.class, name); err != nil {
+				return err
+			}
+
+		case OP_SET_PROPERTY, OP_SET_PROPERTY_LONG:
+			instance, isInstance := vm.peek(1).(*ValueInstance)
+			if !isInstance {
+				return vm.RuntimeError("Only instances have fields.")
+			}
+
+			name := string(vm.readConstantFor(OpCode(instruction)).(ValueString))
+			if _, exists := instance.fields[name]; !exists {
+				if err := vm.allocate(sizeofField + len(name)); err != nil {
+					return err
+				}
+			}
+
+			instance.fields[name] = vm.peek(0)
+
+			value := vm.pop()
+			vm.pop() // instance
+			vm.push(value)
+
+		case OP_GET_SUPER, OP_GET_SUPER_LONG:
+			name := string(vm.readConstantFor(OpCode(instruction)).(ValueString))
+			superclass, isClass := vm.pop().(*ValueClass)
+			if !isClass {
+				return vm.RuntimeError("Superclass must be a class.")
+			}
+
+			if err := vm.bindMethod(superclass, name); err != nil {
+				return err
+			}
+
+		case OP_DEFINE_GLOBAL, OP_DEFINE_GLOBAL_LONG:
+			name := vm.readConstantFor(OpCode(instruction)).(ValueString)
 			vm.globals[string(name)] = vm.peek(0)
 			vm.pop()
 
-		case OP_GET_GLOBAL:
-			name := vm.readConstant().(ValueString)
+		case OP_GET_GLOBAL, OP_GET_GLOBAL_LONG:
+			name := vm.readConstantFor(OpCode(instruction)).(ValueString)
 			value, ok := vm.globals[string(name)]
 			if !ok {
 				return vm.RuntimeError("Undefined variable '%s'.", name)
 			}
 			vm.push(value)
 
-		case OP_SET_GLOBAL:
-			name := string(vm.readConstant().(ValueString))
+		case OP_SET_GLOBAL, OP_SET_GLOBAL_LONG:
+			name := string(vm.readConstantFor(OpCode(instruction)).(ValueString))
 
 			if _, exists := vm.globals[name]; !exists {
 				return vm.RuntimeError("Undefined variable '%s'.", name)
@@ -191,8 +388,8 @@ func (vm *VM) run() error {
 			vm.push(ValueBool(a.Equals(b)))
 
 		case OP_PRINT:
-			PrintValue(vm.pop())
-			fmt.Printf("\n")
+			FprintValue(vm.stdout, vm.pop())
+			fmt.Fprintf(vm.stdout, "\n")
 
 		case OP_JUMP:
 			offset := vm.readShort()
@@ -217,24 +414,100 @@ func (vm *VM) run() error {
 		case OP_CALL:
 			argCount := int(vm.readByte())
 			if err := vm.callValue(vm.peek(argCount), argCount); err != nil {
-				return InterpretRuntimeError
+				return err
 			}
 			frame = vm.currentFrame()
 
+		case OP_INVOKE, OP_INVOKE_LONG:
+			method := string(vm.readConstantFor(OpCode(instruction)).(ValueString))
+			argCount := int(vm.readByte())
+			if err := vm.invoke(method, argCount); err != nil {
+				return err
+			}
+			frame = vm.currentFrame()
+
+		case OP_SUPER_INVOKE, OP_SUPER_INVOKE_LONG:
+			method := string(vm.readConstantFor(OpCode(instruction)).(ValueString))
+			argCount := int(vm.readByte())
+			superclass, isClass := vm.pop().(*ValueClass)
+			if !isClass {
+				return vm.RuntimeError("Superclass must be a class.")
+			}
+
+			if err := vm.invokeFromClass(superclass, method, argCount); err != nil {
+				return err
+			}
+			frame = vm.currentFrame()
+
+		case OP_CLOSURE, OP_CLOSURE_LONG:
+			function := vm.readConstantFor(OpCode(instruction)).(ValueFunction)
+			if err := vm.allocate(sizeofClosure + function.upvalueCount*sizeofUpvalue); err != nil {
+				return err
+			}
+
+			closure := NewClosure(&function)
+			vm.push(closure)
+
+			for i := range closure.upvalues {
+				isLocal := vm.readByte()
+				index := int(vm.readByte())
+
+				if isLocal == 1 {
+					closure.upvalues[i] = vm.captureUpvalue(frame.sp + index)
+				} else {
+					closure.upvalues[i] = frame.closure.upvalues[index]
+				}
+			}
+
+		case OP_CLOSE_UPVALUE:
+			vm.closeUpvalues(vm.sp - 1)
+			vm.pop()
+
 		case OP_RETURN:
 			result := vm.pop()
 			spRestore := vm.currentFrame().sp
+			vm.closeUpvalues(spRestore)
 			vm.frameCount--
-			if vm.frameCount == 0 {
-				vm.pop()
 
+			vm.sp = spRestore
+			vm.push(result)
+
+			if vm.frameCount == base {
 				return nil
 			}
 
-			vm.sp = spRestore
-
-			vm.push(result)
 			frame = vm.currentFrame()
+
+		case OP_CLASS, OP_CLASS_LONG:
+			name := vm.readConstantFor(OpCode(instruction)).(ValueString)
+			if err := vm.allocate(sizeofClass); err != nil {
+				return err
+			}
+
+			vm.push(NewClass(string(name)))
+
+		case OP_INHERIT:
+			superclass, isClass := vm.peek(1).(*ValueClass)
+			if !isClass {
+				return vm.RuntimeError("Superclass must be a class.")
+			}
+
+			subclass, isClass := vm.peek(0).(*ValueClass)
+			if !isClass {
+				return vm.RuntimeError("Only classes can inherit.")
+			}
+
+			for name, method := range superclass.methods {
+				subclass.methods[name] = method
+			}
+
+			vm.pop() // subclass
+
+		case OP_METHOD, OP_METHOD_LONG:
+			name := string(vm.readConstantFor(OpCode(instruction)).(ValueString))
+			if err := vm.defineMethod(name); err != nil {
+				return err
+			}
 		}
 	}
 }
@@ -246,50 +519,93 @@ func (vm *VM) currentFrame() *CallFrame {
 func (vm *VM) readByte() byte {
 	frame := vm.currentFrame()
 	frame.ip++
-	return frame.function.chunk.code[frame.ip-1]
+	return frame.closure.function.chunk.code[frame.ip-1]
 }
 
 func (vm *VM) readConstant() Value {
 	frame := vm.currentFrame()
-	return frame.function.chunk.constantAt(vm.readByte())
+	return frame.closure.function.chunk.constantAt(int(vm.readByte()))
+}
+
+// readConstantLong reads a 24-bit constant index, high byte first
+func (vm *VM) readConstantLong() Value {
+	frame := vm.currentFrame()
+	index := int(vm.readByte()) << 16
+	index |= int(vm.readByte()) << 8
+	index |= int(vm.readByte())
+	return frame.closure.function.chunk.constantAt(index)
+}
+
+// readConstantFor reads whichever width of constant the given op takes
+func (vm *VM) readConstantFor(op OpCode) Value {
+	switch op {
+	case OP_CONSTANT_LONG, OP_DEFINE_GLOBAL_LONG, OP_GET_GLOBAL_LONG,
+		OP_SET_GLOBAL_LONG, OP_CLOSURE_LONG, OP_GET_PROPERTY_LONG,
+		OP_SET_PROPERTY_LONG, OP_GET_SUPER_LONG, OP_INVOKE_LONG,
+		OP_SUPER_INVOKE_LONG, OP_CLASS_LONG, OP_METHOD_LONG:
+		return vm.readConstantLong()
+	default:
+		return vm.readConstant()
+	}
 }
 
 func (vm *VM) readShort() int {
 	frame := vm.currentFrame()
 	frame.ip += 2
-	code := frame.function.chunk.code
-	return int(code[frame.ip-2]<<8 | code[frame.ip-1])
+	code := frame.closure.function.chunk.code
+	return int(code[frame.ip-2])<<8 | int(code[frame.ip-1])
 }
 
+// RuntimeError reports an error along with a stack trace, and returns it as a
+// *RuntimeError. It leaves the stack alone: see unwind.
 func (vm *VM) RuntimeError(format string, args ...any) error {
-	fmt.Fprintf(os.Stderr, format, args...)
-	fmt.Fprintf(os.Stderr, "\n")
+	err := &RuntimeError{
+		Message: fmt.Sprintf(format, args...),
+		Trace:   make([]TraceFrame, 0, vm.frameCount),
+	}
 
 	for i := vm.frameCount - 1; i >= 0; i-- {
 		frame := &vm.frames[i]
-		function := frame.function
+		function := frame.closure.function
 
-		line := frame.function.chunk.GetLine(frame.ip)
-		fmt.Fprintf(os.Stderr, "[line %d] in ", line)
-
-		if function.name == "" {
-			fmt.Fprintf(os.Stderr, "script\n")
-		} else {
-			fmt.Fprintf(os.Stderr, "%s()\n", function.name)
-		}
+		err.Trace = append(err.Trace, TraceFrame{
+			Line:     function.chunk.GetLine(frame.ip),
+			Function: function.name,
+		})
 	}
 
-	vm.resetStack()
+	fmt.Fprintln(vm.stderr, err)
 
-	return InterpretRuntimeError
+	return err
 }
 
 // stack manipulation
 func (vm *VM) push(value Value) {
+	if vm.sp == len(vm.stack) {
+		vm.growStack()
+	}
+
 	vm.stack[vm.sp] = value
 	vm.sp++
 }
 
+// growStack doubles the size of the stack. Everything that points into the
+// old one (frame slots and open upvalues) has to be moved over to the new one.
+func (vm *VM) growStack() {
+	stack := make([]Value, 2*len(vm.stack))
+	copy(stack, vm.stack)
+	vm.stack = stack
+
+	for i := 0; i < vm.frameCount; i++ {
+		frame := &vm.frames[i]
+		frame.slots = vm.stack[frame.sp:]
+	}
+
+	for upvalue := vm.openUpvalues; upvalue != nil; upvalue = upvalue.next {
+		upvalue.location = &vm.stack[upvalue.slot]
+	}
+}
+
 func (vm *VM) pop() Value {
 	vm.sp--
 	return vm.stack[vm.sp]
@@ -301,42 +617,184 @@ func (vm *VM) peek(dist int) Value {
 
 func (vm *VM) callValue(callee Value, argCount int) error {
 	switch callee.(type) {
-	case ValueFunction:
-		function := callee.(ValueFunction)
-		return vm.call(&function, argCount)
+	case *ValueClosure:
+		return vm.call(callee.(*ValueClosure), argCount)
+	case *ValueBoundMethod:
+		bound := callee.(*ValueBoundMethod)
+		vm.stack[vm.sp-argCount-1] = bound.receiver
+		return vm.call(bound.method, argCount)
+	case *ValueClass:
+		class := callee.(*ValueClass)
+		if err := vm.allocate(sizeofInstance); err != nil {
+			return err
+		}
+
+		vm.stack[vm.sp-argCount-1] = NewInstance(class)
+
+		if initializer, ok := class.methods["init"]; ok {
+			return vm.call(initializer.(*ValueClosure), argCount)
+		} else if argCount != 0 {
+			return vm.RuntimeError("Expected 0 arguments but got %d.", argCount)
+		}
+
+		return nil
 	case ValueNative:
-		function := callee.(ValueNative).function
+		native := callee.(ValueNative)
+		if native.arity != VARIADIC && argCount != native.arity {
+			return vm.RuntimeError("Expected %d arguments but got %d.", native.arity, argCount)
+		}
+
 		args := vm.stack[vm.sp-argCount : vm.sp]
-		result := function(argCount, args)
+		result, err := native.function(args)
+		if err != nil {
+			// if the native called back into Lox and that failed, it's
+			// already been reported
+			if errors.Is(err, InterpretRuntimeError) {
+				return err
+			}
+
+			return vm.RuntimeError("%s", err)
+		}
+
+		if result == nil {
+			result = ValueNil(0)
+		}
+
 		vm.sp -= argCount + 1
 		vm.push(result)
 		return nil
-	default:
-		fmt.Fprintf(os.Stderr, "weird call type: %+v", callee)
 	}
 
 	return vm.RuntimeError("Can only call functions and classes")
 }
 
-func (vm *VM) call(function *ValueFunction, argCount int) error {
+func (vm *VM) call(closure *ValueClosure, argCount int) error {
+	function := closure.function
 	if argCount != function.arity {
 		return vm.RuntimeError("Expected %d arguments but got %d.", function.arity, argCount)
 	}
 
-	if vm.frameCount == FRAMES_MAX {
+	if vm.frameCount >= vm.maxFrames {
 		return vm.RuntimeError("Stack overflow.")
 	}
 
+	if vm.frameCount == len(vm.frames) {
+		// anything holding a *CallFrame needs to get it again after this
+		vm.frames = append(vm.frames, make([]CallFrame, len(vm.frames))...)
+	}
+
 	frame := &vm.frames[vm.frameCount]
 	vm.frameCount++
 
-	frame.function = function
+	frame.closure = closure
 	frame.ip = 0
 	frame.slots = vm.stack[vm.sp-argCount-1:]
 	frame.sp = vm.sp - argCount - 1
 	return nil
 }
 
+func (vm *VM) invoke(name string, argCount int) error {
+	receiver := vm.peek(argCount)
+	instance, isInstance := receiver.(*ValueInstance)
+	if !isInstance {
+		return vm.RuntimeError("Only instances have methods.")
+	}
+
+	// a field might shadow a method, in which case we call it like normal
+	if value, ok := instance.fields[name]; ok {
+		vm.stack[vm.sp-argCount-1] = value
+		return vm.callValue(value, argCount)
+	}
+
+	return vm.invokeFromClass(instance.class, name, argCount)
+}
+
+func (vm *VM) invokeFromClass(class *ValueClass, name string, argCount int) error {
+	method, ok := class.methods[name]
+	if !ok {
+		return vm.RuntimeError("Undefined property '%s'.", name)
+	}
+
+	closure, isClosure := method.(*ValueClosure)
+	if !isClosure {
+		return vm.RuntimeError("Method '%s' is not a function.", name)
+	}
+
+	return vm.call(closure, argCount)
+}
+
+// bindMethod replaces the instance on top of the stack with the named method
+// bound to it.
+func (vm *VM) bindMethod(class *ValueClass, name string) error {
+	method, ok := class.methods[name]
+	if !ok {
+		return vm.RuntimeError("Undefined property '%s'.", name)
+	}
+
+	if err := vm.allocate(sizeofBoundMethod); err != nil {
+		return err
+	}
+
+	bound := NewBoundMethod(vm.peek(0), method.(*ValueClosure))
+	vm.pop()
+	vm.push(bound)
+	return nil
+}
+
+func (vm *VM) defineMethod(name string) error {
+	method, isClosure := vm.peek(0).(*ValueClosure)
+	if !isClosure {
+		return vm.RuntimeError("Method '%s' is not a function.", name)
+	}
+
+	class, isClass := vm.peek(1).(*ValueClass)
+	if !isClass {
+		return vm.RuntimeError("Only classes can have methods.")
+	}
+
+	class.methods[name] = method
+	vm.pop()
+	return nil
+}
+
+// captureUpvalue returns the upvalue for the given stack slot, reusing an
+// existing open one if there is one so that closures share variables.
+func (vm *VM) captureUpvalue(slot int) *ValueUpvalue {
+	var prev *ValueUpvalue
+	upvalue := vm.openUpvalues
+
+	for upvalue != nil && upvalue.slot > slot {
+		prev = upvalue
+		upvalue = upvalue.next
+	}
+
+	if upvalue != nil && upvalue.slot == slot {
+		return upvalue
+	}
+
+	created := NewUpvalue(&vm.stack[slot], slot)
+	created.next = upvalue
+
+	if prev == nil {
+		vm.openUpvalues = created
+	} else {
+		prev.next = created
+	}
+
+	return created
+}
+
+// closeUpvalues closes every open upvalue at or above the given stack slot,
+// hoisting the value off the stack and into the upvalue itself.
+func (vm *VM) closeUpvalues(last int) {
+	for vm.openUpvalues != nil && vm.openUpvalues.slot >= last {
+		upvalue := vm.openUpvalues
+		upvalue.closed = *upvalue.location
+		upvalue.location = &upvalue.closed
+		vm.openUpvalues = upvalue.next
+	}
+}
+
 func (vm *VM) binaryOp(oper op.BinaryOp) error {
 	bval := vm.pop()
 	aval := vm.pop()
@@ -368,16 +826,116 @@ func (vm *VM) binaryOp(oper op.BinaryOp) error {
 	return nil
 }
 
-func (vm *VM) concatenate() {
+// indexGet replaces the object and index on top of the stack with the item
+// at that index.
+func (vm *VM) indexGet() error {
+	switch object := vm.peek(1).(type) {
+	case *ValueList:
+		i, err := listIndex(object, vm.peek(0), false)
+		if err != nil {
+			return vm.RuntimeError("%s", err)
+		}
+
+		vm.sp -= 2
+		vm.push(object.items[i])
+		return nil
+
+	case *ValueMap:
+		key := vm.peek(0)
+		value, ok := object.get(key)
+		if !ok {
+			var b strings.Builder
+			FprintValue(&b, key)
+			return vm.RuntimeError("Key '%s' not found.", b.String())
+		}
+
+		vm.sp -= 2
+		vm.push(value)
+		return nil
+	}
+
+	return vm.RuntimeError("Only lists and maps can be indexed.")
+}
+
+// indexSet sets an item from the object, index and value on top of the
+// stack, leaving the value.
+func (vm *VM) indexSet() error {
+	value := vm.peek(0)
+
+	switch object := vm.peek(2).(type) {
+	case *ValueList:
+		i, err := listIndex(object, vm.peek(1), false)
+		if err != nil {
+			return vm.RuntimeError("%s", err)
+		}
+
+		object.items[i] = value
+		vm.sp -= 3
+		vm.push(value)
+		return nil
+
+	case *ValueMap:
+		if err := vm.mapSet(object, vm.peek(1), value); err != nil {
+			return err
+		}
+
+		vm.sp -= 3
+		vm.push(value)
+		return nil
+	}
+
+	return vm.RuntimeError("Only lists and maps can be indexed.")
+}
+
+// buildMap replaces the count key/value pairs on top of the stack with a map
+// containing them.
+func (vm *VM) buildMap(count int) error {
+	if err := vm.allocate(sizeofMap); err != nil {
+		return err
+	}
+
+	m := NewMap()
+	for i := vm.sp - 2*count; i < vm.sp; i += 2 {
+		if err := vm.mapSet(m, vm.stack[i], vm.stack[i+1]); err != nil {
+			return err
+		}
+	}
+
+	vm.sp -= 2 * count
+	vm.push(m)
+	return nil
+}
+
+// mapSet checks that key is hashable and that there's room for it, then sets
+// it in the map.
+func (vm *VM) mapSet(m *ValueMap, key, value Value) error {
+	if err := hashable(key); err != nil {
+		return vm.RuntimeError("%s", err)
+	}
+
+	if _, exists := m.get(key); !exists {
+		if err := vm.allocate(sizeofMapEntry); err != nil {
+			return err
+		}
+	}
+
+	m.set(key, value)
+	return nil
+}
+
+func (vm *VM) concatenate() error {
+	// check the budget before allocating, so that a huge string can't take
+	// down the whole process
+	if err := vm.allocate(len(vm.peek(0).(ValueString)) + len(vm.peek(1).(ValueString))); err != nil {
+		return err
+	}
+
 	b := vm.pop().(ValueString)
 	a := vm.pop().(ValueString)
 	vm.push(ValueString(a + b))
+	return nil
 }
 
-func (vm *VM) defineNative(name string, function NativeFn) {
-	vm.globals[name] = ValueNative{function}
-}
-
-func clockNative(int, []Value) Value {
-	return ValueNumber(time.Now().Unix() - vmStartTime)
+func (vm *VM) defineNative(name string, arity int, function NativeFn) {
+	vm.globals[name] = ValueNative{name, arity, function}
 }
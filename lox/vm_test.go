@@ -0,0 +1,961 @@
+package lox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const stressSource = `
+class Node {
+	init(value, next) {
+		this.value = value;
+		this.next = next;
+	}
+}
+
+class Counter {
+	init() { this.count = 0; }
+	incr() { this.count = this.count + 1; return this.count; }
+}
+
+class LoudCounter < Counter {
+	incr() { return super.incr() * 10; }
+}
+
+fun makeCounter() {
+	var n = 0;
+	fun count() {
+		n = n + 1;
+		return n;
+	}
+	return count;
+}
+
+fun fib(n) {
+	if (n < 2) return n;
+	return fib(n - 2) + fib(n - 1);
+}
+
+var list = nil;
+for (var i = 0; i < 50; i = i + 1) {
+	list = Node(i, list);
+}
+
+var sum = 0;
+while (list != nil) {
+	sum = sum + list.value;
+	list = list.next;
+}
+print sum;
+
+var counter = makeCounter();
+counter();
+counter();
+print counter();
+
+var loud = LoudCounter();
+loud.incr();
+print loud.incr();
+
+print fib(15);
+print "done" + "!";
+`
+
+const stressOutput = "1225\n3\n20\n610\ndone!\n"
+
+func TestRunParallel(t *testing.T) {
+	function, err := CompileWithDiagnostics(stressSource, io.Discard)
+	if err != nil {
+		t.Fatalf("compile: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var stdout, stderr bytes.Buffer
+			if err := Run(function, &stdout, &stderr); err != nil {
+				t.Errorf("run: %s\n%s", err, stderr.String())
+				return
+			}
+
+			if got := stdout.String(); got != stressOutput {
+				t.Errorf("expected output %q, got %q", stressOutput, got)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestVMsAreIndependent(t *testing.T) {
+	function, err := CompileWithDiagnostics(`
+		var total = 0;
+		fun add(n) {
+			total = total + n;
+			return total;
+		}
+	`, io.Discard)
+	if err != nil {
+		t.Fatalf("compile: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			vm := NewVM()
+			vm.SetStdout(io.Discard)
+			vm.SetStderr(io.Discard)
+
+			if err := vm.Interpret(function); err != nil {
+				t.Errorf("interpret: %s", err)
+				return
+			}
+
+			var result any
+			for j := 0; j < 100; j++ {
+				var err error
+				result, err = vm.Call("add", i)
+				if err != nil {
+					t.Errorf("call: %s", err)
+					return
+				}
+			}
+
+			if want := float64(100 * i); result != want {
+				t.Errorf("vm %d: expected total %g, got %v", i, want, result)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func TestRuntimeErrorsParallel(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			source := fmt.Sprintf("fun f%d() { return nil + %d; }\nf%d();\n", i, i, i)
+
+			var stderr bytes.Buffer
+			vm := NewVM()
+			vm.SetStderr(&stderr)
+
+			err := vm.InterpretString(source)
+
+			runtimeErr, ok := err.(*RuntimeError)
+			if !ok {
+				t.Errorf("expected *RuntimeError, got %v", err)
+				return
+			}
+
+			if len(runtimeErr.Trace) != 2 || runtimeErr.Trace[0].Function != fmt.Sprintf("f%d", i) {
+				t.Errorf("unexpected trace: %v", runtimeErr.Trace)
+			}
+
+			if !strings.Contains(stderr.String(), runtimeErr.Message) {
+				t.Errorf("expected %q in stderr, got %q", runtimeErr.Message, stderr.String())
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func TestDebugOutputGoesToWriters(t *testing.T) {
+	var stdouts, stderrs [2]bytes.Buffer
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			vm := NewVM()
+			vm.SetStdout(&stdouts[i])
+			vm.SetStderr(&stderrs[i])
+			vm.SetDebug(DebugFlags{PrintCode: true, TraceExecution: true})
+
+			source := fmt.Sprintf("fun vm%d() { print \"out %d\"; return nil + %d; }\nvm%d();", i, i, i, i)
+			if err := vm.InterpretString(source); err == nil {
+				t.Errorf("vm %d: expected a runtime error", i)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	for i := 0; i < 2; i++ {
+		stdout, stderr := stdouts[i].String(), stderrs[i].String()
+		other := 1 - i
+
+		// the disassembly, the trace, and the program's own output
+		for _, want := range []string{fmt.Sprintf("== vm%d ==", i), "OP_PRINT", "[ ", fmt.Sprintf("out %d\n", i)} {
+			if !strings.Contains(stdout, want) {
+				t.Errorf("vm %d: expected %q in stdout, got %q", i, want, stdout)
+			}
+		}
+
+		if strings.Contains(stdout, fmt.Sprintf("vm%d", other)) {
+			t.Errorf("vm %d: got output from vm %d: %q", i, other, stdout)
+		}
+
+		if !strings.Contains(stderr, fmt.Sprintf("in vm%d()", i)) || strings.Contains(stderr, fmt.Sprintf("vm%d", other)) {
+			t.Errorf("vm %d: expected only its own error in stderr, got %q", i, stderr)
+		}
+	}
+}
+
+func TestCallValueErrorFromNative(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	vm := NewVM()
+	vm.SetStdout(&stdout)
+	vm.SetStderr(&stderr)
+
+	vm.RegisterNative("try", 1, func(args []Value) (Value, error) {
+		if _, err := vm.CallValue(args[0]); err != nil {
+			return ValueBool(false), nil
+		}
+		return ValueBool(true), nil
+	})
+
+	err := vm.InterpretString(`
+		fun bad() { return nil + 1; }
+		fun good() { return 1; }
+		fun outer() {
+			var x = "captured";
+			fun inner() { return x; }
+			var ok = try(bad);
+			return inner() + " " + str(ok);
+		}
+		print try(bad);
+		print try(good);
+		print outer();
+	`)
+	if err != nil {
+		t.Fatalf("interpret: %s\n%s", err, stderr.String())
+	}
+
+	if want := "false\ntrue\ncaptured false\n"; stdout.String() != want {
+		t.Errorf("expected output %q, got %q", want, stdout.String())
+	}
+
+	if !strings.Contains(stderr.String(), "Operands must be") {
+		t.Errorf("expected the error to be reported, got %q", stderr.String())
+	}
+}
+
+func TestStringNativesCountAgainstMemoryLimit(t *testing.T) {
+	calls := []string{
+		`str(big)`,
+		`upper(s)`,
+		`lower(s)`,
+		`trim(s)`,
+		`substr(s, 0)`,
+	}
+
+	for _, call := range calls {
+		vm := NewVM()
+		vm.SetStderr(io.Discard)
+
+		// big is a list that prints as a string much longer than s, and
+		// every call makes a new string of at least s's length
+		err := vm.InterpretString(`
+			var s = " xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx ";
+			var big = [s, s, s, s, s, s, s, s];
+		`)
+		if err != nil {
+			t.Fatalf("interpret: %s", err)
+		}
+
+		vm.SetMemoryLimit(1000)
+		source := fmt.Sprintf("for (var i = 0; i < 100; i = i + 1) %s;", call)
+
+		var limitErr *MemoryLimitError
+		if err := vm.InterpretString(source); !errors.As(err, &limitErr) {
+			t.Errorf("%s: expected a *MemoryLimitError, got %v", call, err)
+		}
+	}
+}
+
+func TestRangeWithFractionalStep(t *testing.T) {
+	var stdout bytes.Buffer
+	vm := NewVM()
+	vm.SetStdout(&stdout)
+	vm.SetStderr(io.Discard)
+
+	err := vm.InterpretString(`
+		var n = 0;
+		for (var x in range(0, 1, 0.1)) n = n + 1;
+		print n;
+	`)
+	if err != nil {
+		t.Fatalf("interpret: %s", err)
+	}
+
+	if got := stdout.String(); got != "10\n" {
+		t.Errorf("expected 10 numbers, got %q", got)
+	}
+
+	if err := vm.InterpretString(`range(0, 0/0);`); err == nil {
+		t.Errorf("expected an error for a NaN range")
+	}
+}
+
+// checkReusable makes sure a VM still works after a run was stopped: the
+// stack and frames are empty, and it can run new code and call old code.
+func checkReusable(t *testing.T, vm *VM, stdout *bytes.Buffer) {
+	t.Helper()
+
+	if vm.sp != 0 || vm.frameCount != 0 {
+		t.Errorf("expected an empty stack after stopping, got sp=%d frames=%d", vm.sp, vm.frameCount)
+	}
+
+	stdout.Reset()
+	if err := vm.InterpretString(`print double(21);`); err != nil {
+		t.Fatalf("interpret after stopping: %s", err)
+	}
+
+	if got := stdout.String(); got != "42\n" {
+		t.Errorf("expected 42, got %q", got)
+	}
+
+	if result, err := vm.Call("double", 2); err != nil || result != float64(4) {
+		t.Errorf("expected double(2) to be 4, got %v (%v)", result, err)
+	}
+}
+
+func TestInstructionLimit(t *testing.T) {
+	var stdout bytes.Buffer
+	vm := NewVM()
+	vm.SetStdout(&stdout)
+	vm.SetStderr(io.Discard)
+
+	if err := vm.InterpretString(`fun double(n) { return n * 2; }`); err != nil {
+		t.Fatalf("interpret: %s", err)
+	}
+
+	vm.SetInstructionLimit(1000)
+	err := vm.InterpretString("var i = 0;\nwhile (true) {\n  i = i + 1;\n}")
+
+	var limitErr *ExecutionLimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("expected an *ExecutionLimitError, got %v", err)
+	}
+
+	if !errors.Is(err, ErrInstructionLimit) || !errors.Is(err, InterpretRuntimeError) {
+		t.Errorf("expected the error to match ErrInstructionLimit and InterpretRuntimeError: %v", err)
+	}
+
+	if limitErr.Line < 2 || limitErr.Line > 4 {
+		t.Errorf("expected the error to be in the loop, got line %d", limitErr.Line)
+	}
+
+	// the limit counts from when it was set, so setting it again is a fresh
+	// budget
+	vm.SetInstructionLimit(1000)
+	checkReusable(t, vm, &stdout)
+
+	// and the budget is shared across runs until it's reset
+	vm.SetInstructionLimit(100)
+	for i := 0; i < 100; i++ {
+		if err = vm.InterpretString(`double(1);`); err != nil {
+			break
+		}
+	}
+
+	if !errors.Is(err, ErrInstructionLimit) {
+		t.Errorf("expected repeated runs to use up the limit, got %v", err)
+	}
+}
+
+func TestContextCancellation(t *testing.T) {
+	var stdout bytes.Buffer
+	vm := NewVM()
+	vm.SetStdout(&stdout)
+	vm.SetStderr(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	vm.SetContext(ctx)
+
+	// the script cancels its own context partway through
+	vm.RegisterNative("cancel", 0, func(args []Value) (Value, error) {
+		cancel()
+		return nil, nil
+	})
+
+	err := vm.InterpretString(`
+		fun double(n) { return n * 2; }
+		for (var i = 0; ; i = i + 1) {
+			if (i == 10) cancel();
+		}
+	`)
+
+	var limitErr *ExecutionLimitError
+	if !errors.As(err, &limitErr) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected an *ExecutionLimitError for context.Canceled, got %v", err)
+	}
+
+	if limitErr.Line != 4 {
+		t.Errorf("expected the error on line 4, got %d", limitErr.Line)
+	}
+
+	// a cancelled context stops everything until it's replaced, including
+	// calls from the host, at the next check
+	err = nil
+	for i := 0; i < CONTEXT_CHECK_INTERVAL && err == nil; i++ {
+		_, err = vm.Call("double", 1)
+	}
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected calls to stop once the context is cancelled, got %v", err)
+	}
+
+	vm.SetContext(context.Background())
+	checkReusable(t, vm, &stdout)
+}
+
+func TestContextDeadline(t *testing.T) {
+	vm := NewVM()
+	vm.SetStderr(io.Discard)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	vm.SetContext(ctx)
+
+	done := make(chan error, 1)
+	go func() { done <- vm.InterpretString(`while (true) {}`) }()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, InterpretRuntimeError) {
+			t.Errorf("expected the deadline to stop the VM, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the VM didn't stop at its deadline")
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	var stdout bytes.Buffer
+	vm := NewVM()
+	vm.SetStdout(&stdout)
+	vm.SetStderr(io.Discard)
+
+	if err := vm.InterpretString(`fun double(n) { return n * 2; }`); err != nil {
+		t.Fatalf("interpret: %s", err)
+	}
+
+	// each of these would allocate without end, in a loop on the last line
+	sources := map[string]string{
+		"concatenation": "var s = \"x\";\nwhile (true) s = s + s;",
+		"instances":     "class A {}\nvar all = [];\nwhile (true) push(all, A());",
+		"closures":      "fun f() {}\nwhile (true) { fun g() { return f; } }",
+		"lists":         "var l = [];\nwhile (true) l = [l, l];",
+		"fields":        "class A {}\nvar a = A();\nfor (var i = 0; ; i = i + 1) a.x = str(i);",
+	}
+
+	for name, source := range sources {
+		vm.SetMemoryLimit(10000)
+		err := vm.InterpretString(source)
+
+		var memErr *MemoryLimitError
+		if !errors.As(err, &memErr) {
+			t.Errorf("%s: expected a *MemoryLimitError, got %v", name, err)
+			continue
+		}
+
+		if !errors.Is(err, InterpretRuntimeError) {
+			t.Errorf("%s: expected the error to match InterpretRuntimeError", name)
+		}
+
+		line := strings.Count(source, "\n") + 1
+		if memErr.Limit != 10000 || memErr.Line != line {
+			t.Errorf("%s: expected the limit 10000 on line %d, got %d on line %d", name, line, memErr.Limit, memErr.Line)
+		}
+
+		if got := vm.BytesAllocated(); got == 0 || got > 10000 {
+			t.Errorf("%s: expected to stop within the limit, got %d bytes", name, got)
+		}
+	}
+
+	vm.SetMemoryLimit(0)
+	checkReusable(t, vm, &stdout)
+
+	// with no limit, the same kind of thing just runs
+	if err := vm.InterpretString(`var s = "x"; for (var i = 0; i < 16; i = i + 1) s = s + s;`); err != nil {
+		t.Errorf("expected no error without a limit, got %v", err)
+	}
+}
+
+func TestStackGrowsUnderOpenUpvalue(t *testing.T) {
+	var stdout bytes.Buffer
+	vm := NewVM()
+	vm.SetStdout(&stdout)
+
+	// x is still open (outer hasn't returned) when deep recursion grows the
+	// stack out from under it, so its upvalue has to move along with it
+	err := vm.InterpretString(`
+		fun outer() {
+			var x = "before";
+			fun get() { return x; }
+			fun set(v) { x = v; }
+
+			fun deep(n) {
+				var a = n; var b = n; var c = n;
+				if (n == 0) {
+					set("during");
+					return get();
+				}
+				return deep(n - 1);
+			}
+
+			var during = deep(200);
+			print during;
+			print x;
+
+			x = "after";
+			print get();
+		}
+		outer();
+	`)
+	if err != nil {
+		t.Fatalf("interpret: %s", err)
+	}
+
+	if want := "during\nduring\nafter\n"; stdout.String() != want {
+		t.Errorf("expected %q, got %q", want, stdout.String())
+	}
+
+	if len(vm.stack) <= STACK_INITIAL || len(vm.frames) <= FRAMES_INITIAL {
+		t.Errorf("expected the stack and frames to have grown, got %d and %d", len(vm.stack), len(vm.frames))
+	}
+}
+
+func TestMaxFrames(t *testing.T) {
+	var stdout bytes.Buffer
+	vm := NewVM()
+	vm.SetStdout(&stdout)
+	vm.SetStderr(io.Discard)
+
+	source := `
+		fun double(n) { return n * 2; }
+		fun count(n) {
+			if (n == 0) return 0;
+			return 1 + count(n - 1);
+		}
+		print count(500);
+	`
+
+	// the default allows plenty for this
+	if err := vm.InterpretString(source); err != nil {
+		t.Fatalf("interpret: %s", err)
+	}
+
+	if stdout.String() != "500\n" {
+		t.Errorf("expected 500, got %q", stdout.String())
+	}
+
+	vm.SetMaxFrames(100)
+	err := vm.InterpretString(source)
+
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) || runtimeErr.Message != "Stack overflow." {
+		t.Fatalf("expected a stack overflow, got %v", err)
+	}
+
+	if len(runtimeErr.Trace) != 100 {
+		t.Errorf("expected a trace 100 frames deep, got %d", len(runtimeErr.Trace))
+	}
+
+	checkReusable(t, vm, &stdout)
+}
+
+func TestNativeCallsBackDeeply(t *testing.T) {
+	var stdout bytes.Buffer
+	vm := NewVM()
+	vm.SetStdout(&stdout)
+
+	// every level of recursion goes through Go and back, so the frames
+	// grow while a native (and the run loop that called it) is in progress
+	vm.RegisterNative("again", 2, func(args []Value) (Value, error) {
+		return vm.CallValue(args[0], args[1])
+	})
+
+	err := vm.InterpretString(`
+		fun rec(n) {
+			var here = n;
+			fun get() { return here; }
+			if (n == 0) return 0;
+			var sum = again(rec, n - 1) + get();
+			return sum;
+		}
+		print rec(300);
+	`)
+	if err != nil {
+		t.Fatalf("interpret: %s", err)
+	}
+
+	if want := "45150\n"; stdout.String() != want {
+		t.Errorf("expected %q, got %q", want, stdout.String())
+	}
+
+	if vm.sp != 0 || vm.frameCount != 0 {
+		t.Errorf("expected an empty stack afterward, got sp=%d frames=%d", vm.sp, vm.frameCount)
+	}
+}
+
+func TestNativeArityAndErrors(t *testing.T) {
+	var stdout bytes.Buffer
+	vm := NewVM()
+	vm.SetStdout(&stdout)
+	vm.SetStderr(io.Discard)
+
+	vm.RegisterNative("pair", 2, func(args []Value) (Value, error) {
+		return NewList([]Value{args[0], args[1]}), nil
+	})
+
+	vm.RegisterNative("count", VARIADIC, func(args []Value) (Value, error) {
+		return ValueNumber(len(args)), nil
+	})
+
+	vm.RegisterNative("nothing", 0, func(args []Value) (Value, error) {
+		return nil, nil
+	})
+
+	errNope := errors.New("nope, not today")
+	vm.RegisterNative("fail", 1, func(args []Value) (Value, error) {
+		return nil, errNope
+	})
+
+	err := vm.InterpretString(`
+		print pair(1, "a");
+		print count();
+		print count(1, 2, 3, 4, 5);
+		print nothing();
+	`)
+	if err != nil {
+		t.Fatalf("interpret: %s", err)
+	}
+
+	if want := "[1, a]\n0\n5\nnil\n"; stdout.String() != want {
+		t.Errorf("expected %q, got %q", want, stdout.String())
+	}
+
+	tests := []struct {
+		source  string
+		message string
+	}{
+		{"pair(1);", "Expected 2 arguments but got 1."},
+		{"pair(1, 2, 3);", "Expected 2 arguments but got 3."},
+		{"nothing(1);", "Expected 0 arguments but got 1."},
+		{"fail(1);", "nope, not today"},
+	}
+
+	for _, test := range tests {
+		// wrapped in a function, to check the trace
+		source := fmt.Sprintf("fun wrapper() {\n  %s\n}\nwrapper();", test.source)
+		err := vm.InterpretString(source)
+
+		var runtimeErr *RuntimeError
+		if !errors.As(err, &runtimeErr) {
+			t.Errorf("%s: expected a *RuntimeError, got %v", test.source, err)
+			continue
+		}
+
+		if runtimeErr.Message != test.message {
+			t.Errorf("%s: expected %q, got %q", test.source, test.message, runtimeErr.Message)
+		}
+
+		want := []TraceFrame{{Line: 2, Function: "wrapper"}, {Line: 4, Function: ""}}
+		if len(runtimeErr.Trace) != 2 || runtimeErr.Trace[0] != want[0] || runtimeErr.Trace[1] != want[1] {
+			t.Errorf("%s: expected trace %v, got %v", test.source, want, runtimeErr.Trace)
+		}
+	}
+
+	// from the host, the native's error comes back as a runtime error too
+	_, err = vm.Call("fail", 1)
+
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) || runtimeErr.Message != errNope.Error() {
+		t.Errorf("expected a *RuntimeError from calling fail, got %v", err)
+	}
+
+	if _, err := vm.Call("pair", 1); !errors.Is(err, InterpretRuntimeError) {
+		t.Errorf("expected an arity error from calling pair, got %v", err)
+	}
+}
+
+// interpretOutput runs source in a fresh VM and returns what it printed. The
+// instruction limit is there so a loop that never ends fails the test rather
+// than hanging it.
+func interpretOutput(t *testing.T, source string) string {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	vm := NewVM()
+	vm.SetStdout(&stdout)
+	vm.SetStderr(&stderr)
+	vm.SetInstructionLimit(1000000)
+
+	if err := vm.InterpretString(source); err != nil {
+		t.Errorf("interpret: %s\n%s", err, stderr.String())
+	}
+
+	return stdout.String()
+}
+
+func TestBreakAndContinue(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			"break out of nested loops pops the body's locals",
+			`for (var i = 0; i < 2; i = i + 1) {
+				var a = "a" + str(i);
+				var j = 0;
+				while (true) {
+					var b = "b";
+					{
+						var c = "c";
+						if (j == 1) break;
+					}
+					print a + b + str(j);
+					j = j + 1;
+				}
+				var after = "!";
+				print a + after;
+			}
+			var last = "done";
+			print last;`,
+			"a0b0\na0!\na1b0\na1!\ndone\n",
+		},
+		{
+			"break only leaves the innermost loop",
+			`for (var i = 0; i < 3; i = i + 1) {
+				for (var j = 0; j < 3; j = j + 1) {
+					if (j > i) break;
+					print str(i) + str(j);
+				}
+			}`,
+			"00\n10\n11\n20\n21\n22\n",
+		},
+		{
+			"continue in a for loop runs the increment",
+			`for (var i = 0; i < 5; i = i + 1) {
+				var skip = i == 1 or i == 3;
+				if (skip) continue;
+				print i;
+			}`,
+			"0\n2\n4\n",
+		},
+		{
+			"continue in a while loop checks the condition",
+			`var i = 0;
+			while (i < 4) {
+				i = i + 1;
+				if (i == 2) continue;
+				print i;
+			}`,
+			"1\n3\n4\n",
+		},
+		{
+			"continue closes captured locals",
+			`var fns = [];
+			for (var i = 0; i < 3; i = i + 1) {
+				var x = i * 10;
+				fun f() { return x; }
+				push(fns, f);
+				if (i < 2) continue;
+				x = 99;
+			}
+			for (var f in fns) print f();`,
+			"0\n10\n99\n",
+		},
+		{
+			"break closes captured locals",
+			`var f;
+			while (true) {
+				var x = "captured";
+				fun g() { return x; }
+				f = g;
+				break;
+			}
+			var clobber = "clobbered";
+			print f();`,
+			"captured\n",
+		},
+		{
+			"break and continue in for-in",
+			`for (var x in [1, 2, 3, 4, 5]) {
+				var y = x * 2;
+				if (x == 2) continue;
+				if (x == 4) break;
+				print y;
+			}`,
+			"2\n6\n",
+		},
+	}
+
+	for _, test := range tests {
+		if got := interpretOutput(t, test.source); got != test.want {
+			t.Errorf("%s: expected %q, got %q", test.name, test.want, got)
+		}
+	}
+}
+
+func TestBreakAndContinueOutsideLoop(t *testing.T) {
+	tests := map[string]string{
+		"break;":               "Error at 'break': Can't use 'break' outside of a loop or switch.",
+		"continue;":            "Error at 'continue': Can't use 'continue' outside of a loop.",
+		"if (true) { break; }": "Error at 'break': Can't use 'break' outside of a loop or switch.",
+
+		// a function body is a fresh start, even inside a loop
+		"while (true) { fun f() { continue; } }": "Error at 'continue': Can't use 'continue' outside of a loop.",
+	}
+
+	for source, want := range tests {
+		_, err := CompileWithDiagnostics(source, io.Discard)
+
+		var compileErr *CompileError
+		if !errors.As(err, &compileErr) || len(compileErr.Diagnostics) != 1 {
+			t.Errorf("%s: expected one compile error, got %v", source, err)
+			continue
+		}
+
+		if got := compileErr.Diagnostics[0].String(); got != "[line 1] "+want {
+			t.Errorf("%s: expected %q, got %q", source, want, got)
+		}
+	}
+}
+
+func TestSwitch(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			"comma cases",
+			`for (var i = 0; i < 6; i = i + 1) {
+				switch (i) {
+					case 0: print "zero";
+					case 1, 2, 3: print "small";
+					case 4, 5: print "big";
+				}
+			}`,
+			"zero\nsmall\nsmall\nsmall\nbig\nbig\n",
+		},
+		{
+			"default first still runs last",
+			`for (var x in ["a", "b", "c"]) {
+				switch (x) {
+					default: print "default " + x;
+					case "a": print "a";
+					case "b": print "b";
+				}
+			}`,
+			"a\nb\ndefault c\n",
+		},
+		{
+			"no match and no default does nothing",
+			`switch (7) { case 1: print "one"; } print "after";`,
+			"after\n",
+		},
+		{
+			"no fallthrough",
+			`switch (1) {
+				case 1: print "one";
+				case 2: print "two";
+				default: print "default";
+			}`,
+			"one\n",
+		},
+		{
+			"the subject is evaluated once",
+			`var calls = 0;
+			fun next() { calls = calls + 1; return calls; }
+			switch (next()) {
+				case 5: print "five";
+				case 4: print "four";
+				case 1: print "one";
+				case 3: print "three";
+			}
+			print calls;`,
+			"one\n1\n",
+		},
+		{
+			"case bodies have their own locals",
+			`var s = "outer";
+			switch (2) {
+				case 1: var s = "one"; print s;
+				case 2: var s = "two"; var t = s + "!"; print t;
+			}
+			print s;`,
+			"two!\nouter\n",
+		},
+		{
+			"break leaves the switch, not the loop",
+			`for (var i = 0; i < 3; i = i + 1) {
+				switch (i) {
+					case 1:
+						var skipped = "skipped";
+						if (i == 1) break;
+						print skipped;
+					default:
+						print i;
+				}
+				var after = "after " + str(i);
+				print after;
+			}`,
+			"0\nafter 0\nafter 1\n2\nafter 2\n",
+		},
+		{
+			"break in a nested switch leaves the inner one",
+			`switch (1) {
+				case 1:
+					switch (2) {
+						case 2: break; print "unreachable";
+					}
+					print "outer";
+			}`,
+			"outer\n",
+		},
+		{
+			"continue in a switch goes to the loop",
+			`for (var i = 0; i < 4; i = i + 1) {
+				var x = i * 10;
+				switch (i) {
+					case 1, 2:
+						var y = x;
+						continue;
+				}
+				print x;
+			}`,
+			"0\n30\n",
+		},
+	}
+
+	for _, test := range tests {
+		if got := interpretOutput(t, test.source); got != test.want {
+			t.Errorf("%s: expected %q, got %q", test.name, test.want, got)
+		}
+	}
+}